@@ -0,0 +1,68 @@
+package amqpService
+
+import (
+	"github.com/streadway/amqp"
+	"log"
+	"sync"
+)
+
+// sessionAcknowledger settles deliveries of a session and closes the session once it is retired
+// and all its deliveries were settled, so the receiver can finish jobs after the consumers stopped.
+type sessionAcknowledger struct {
+	acknowledger amqp.Acknowledger
+	close        func() error
+	mutex        sync.Mutex
+	unsettled    int
+	retired      bool
+	closed       bool
+}
+
+func newSessionAcknowledger(acknowledger amqp.Acknowledger, close func() error) *sessionAcknowledger {
+	return &sessionAcknowledger{acknowledger: acknowledger, close: close}
+}
+
+// deliver counts a delivery passed to the receiver, it must be settled by Ack or Nack exactly once.
+func (a *sessionAcknowledger) deliver() {
+	a.mutex.Lock()
+	a.unsettled++
+	a.mutex.Unlock()
+}
+
+func (a *sessionAcknowledger) Ack(tag uint64, multiple bool) error {
+	defer a.settled()
+	return a.acknowledger.Ack(tag, multiple)
+}
+
+func (a *sessionAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	defer a.settled()
+	return a.acknowledger.Nack(tag, multiple, requeue)
+}
+
+func (a *sessionAcknowledger) settled() {
+	a.mutex.Lock()
+	a.unsettled--
+	a.mutex.Unlock()
+	a.closeIfDone()
+}
+
+// retire marks the session as no longer consumed, it is closed as soon as no delivery is unsettled.
+func (a *sessionAcknowledger) retire() {
+	a.mutex.Lock()
+	a.retired = true
+	a.mutex.Unlock()
+	a.closeIfDone()
+}
+
+func (a *sessionAcknowledger) closeIfDone() {
+	a.mutex.Lock()
+	done := a.retired && a.unsettled == 0 && !a.closed
+	if done {
+		a.closed = true
+	}
+	a.mutex.Unlock()
+	if done {
+		if err := a.close(); err != nil {
+			log.Printf("cannot close retired session: %s", err)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package amqpService
+
+import (
+	"testing"
+)
+
+type fakeAcknowledger struct{}
+
+func (fakeAcknowledger) Ack(tag uint64, multiple bool) error                { return nil }
+func (fakeAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error { return nil }
+func (fakeAcknowledger) Reject(tag uint64, requeue bool) error              { return nil }
+
+func TestSessionAcknowledgerClosesAfterSettled(t *testing.T) {
+	closed := 0
+	acknowledger := newSessionAcknowledger(fakeAcknowledger{}, func() error {
+		closed++
+		return nil
+	})
+	acknowledger.deliver()
+	acknowledger.deliver()
+	acknowledger.Ack(1, false)
+	if closed != 0 {
+		t.Fatal("session closed before it was retired")
+	}
+	acknowledger.retire()
+	if closed != 0 {
+		t.Fatal("session closed with an unsettled delivery")
+	}
+	acknowledger.Nack(2, false, true)
+	if closed != 1 {
+		t.Fatalf("expected session closed once after the last delivery was settled, closed %d times", closed)
+	}
+}
+
+func TestSessionAcknowledgerClosesWhenIdle(t *testing.T) {
+	closed := 0
+	acknowledger := newSessionAcknowledger(fakeAcknowledger{}, func() error {
+		closed++
+		return nil
+	})
+	acknowledger.retire()
+	acknowledger.retire()
+	if closed != 1 {
+		t.Fatalf("expected idle session closed once when retired, closed %d times", closed)
+	}
+}
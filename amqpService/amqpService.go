@@ -1,16 +1,44 @@
 package amqpService
 
 import (
+	"fmt"
 	"github.com/deploji/deploji-server/dto"
+	"github.com/deploji/deploji-worker/brokerService"
+	"github.com/deploji/deploji-worker/utils"
 	"github.com/streadway/amqp"
 	"golang.org/x/net/context"
 	"log"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+	"time"
 )
 
-var (
-	Jobs        = make(chan dto.Message)
-	JobStatuses = make(chan dto.Message)
-)
+// JobLog is a part of job output, it is published with routing key returned by JobLogRoutingKey.
+// Events are published with routing key returned by JobEventRoutingKey, consumers bind "job.<id>.#" to get both.
+type JobLog struct {
+	JobID uint
+	Body  dto.Message
+	Event bool
+}
+
+// JobLogRoutingKey returns the routing key of logs of given job.
+func JobLogRoutingKey(jobID uint) string {
+	return fmt.Sprintf("job.%d", jobID)
+}
+
+// JobEventRoutingKey returns the routing key of structured events of given job.
+func JobEventRoutingKey(jobID uint) string {
+	return fmt.Sprintf("job.%d.events", jobID)
+}
+
+func (l JobLog) routingKey() string {
+	if l.Event {
+		return JobEventRoutingKey(l.JobID)
+	}
+	return JobLogRoutingKey(l.JobID)
+}
 
 // session composes an amqp.Connection with an amqp.Channel
 type session struct {
@@ -26,13 +54,20 @@ func (s session) Close() error {
 	return s.Connection.Close()
 }
 
-// redial continually connects to the URL
+// redial continually connects to the URL. Failed dials are retried with exponential backoff and jitter,
+// the delay is capped by AMQP_RECONNECT_MAX_DELAY seconds. Sessions closed shortly after they were
+// established count as failures too, so a broker accepting connections but closing them does not cause a busy loop.
 func Redial(ctx context.Context, url string) chan chan session {
 	sessions := make(chan chan session)
 
 	go func() {
 		sess := make(chan session)
 		defer close(sessions)
+		defer close(sess)
+
+		maxDelay := time.Duration(utils.GetEnvInt("AMQP_RECONNECT_MAX_DELAY", 60)) * time.Second
+		failures := 0
+		var established time.Time
 
 		for {
 			select {
@@ -42,20 +77,39 @@ func Redial(ctx context.Context, url string) chan chan session {
 				return
 			}
 
-			conn, err := amqp.Dial(url)
-			if err != nil {
-				log.Fatalf("cannot (re)dial: %v: %q", err, url)
+			if !established.IsZero() && time.Since(established) < minSessionLifetime {
+				failures++
+			} else {
+				failures = 0
 			}
 
-			ch, err := conn.Channel()
-			if err != nil {
-				log.Fatalf("cannot create channel: %v", err)
+			var conn *amqp.Connection
+			var ch *amqp.Channel
+			for {
+				if failures > 0 {
+					delay := backoff(failures, maxDelay)
+					log.Printf("reconnecting in %s", delay)
+					select {
+					case <-time.After(delay):
+					case <-ctx.Done():
+						log.Println("shutting down session factory")
+						return
+					}
+				}
+				var err error
+				if conn, ch, err = dial(url); err == nil {
+					break
+				}
+				log.Printf("cannot (re)dial: %v", err)
+				failures++
 			}
+			established = time.Now()
 
 			select {
 			case sess <- session{conn, ch}:
 			case <-ctx.Done():
 				log.Println("shutting down new session")
+				conn.Close()
 				return
 			}
 		}
@@ -64,96 +118,209 @@ func Redial(ctx context.Context, url string) chan chan session {
 	return sessions
 }
 
-// publish publishes messages to a reconnecting session to a fanout exchange.
-// It receives from the application specific source of messages.
-func Publish(sessions chan chan session, messages <-chan dto.Message, exchangeName string) {
-	for session := range sessions {
-		var (
-			running bool
-			reading = messages
-			pending = make(chan dto.Message, 1)
-			confirm = make(chan amqp.Confirmation, 1)
-		)
+// minSessionLifetime is the minimal lifetime of a session for it to be considered healthy.
+const minSessionLifetime = 10 * time.Second
 
-		pub := <-session
+func dial(url string) (*amqp.Connection, *amqp.Channel, error) {
+	conn, err := amqp.Dial(url)
+	if err != nil {
+		return nil, nil, err
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("cannot create channel: %v", err)
+	}
+	return conn, ch, nil
+}
 
-		if err := pub.Channel.ExchangeDeclare(exchangeName, "fanout", true, false, false, false, nil); err != nil {
-			log.Printf("cannot declare fanout exchange: %v", err)
+// backoff returns the delay before the next reconnection attempt: exponentially growing from one second
+// up to maxDelay, randomized to the upper half of the interval so workers do not reconnect all at once.
+func backoff(failures int, maxDelay time.Duration) time.Duration {
+	delay := maxDelay
+	if failures < 32 && time.Second<<uint(failures-1) < maxDelay {
+		delay = time.Second << uint(failures-1)
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// Subscribe consumes messages from the queues on a single channel. Prefetch limits the number of unacknowledged
+// deliveries of all the queues together, it should match the number of messages the application is able to process
+// concurrently. Deliveries are not acknowledged, the receiver is responsible for calling Ack or Nack when it is done.
+// When ctx is cancelled or the broker cancels the consumers, deliveries not yet passed to the receiver are requeued,
+// the connection is kept open until the receiver acknowledges the messages it is processing.
+func Subscribe(ctx context.Context, sessions chan chan session, deliveries chan<- *brokerService.Delivery, queueNames []string, prefetch int) {
+	for session := range sessions {
+		sub, ok := <-session
+		if !ok {
+			return
 		}
 
-		// publisher confirms for this channel/connection
-		if err := pub.Confirm(false); err != nil {
-			log.Printf("publisher confirms not supported")
-			close(confirm) // confirms not supported, simulate by always nacking
-		} else {
-			pub.NotifyPublish(confirm)
+		msgs, tags, err := consume(sub, queueNames, prefetch)
+		if err != nil {
+			log.Printf("cannot consume from queues: %s, %s", strings.Join(queueNames, ","), err)
+			sub.Close()
+			continue
 		}
+		closed := sub.Connection.NotifyClose(make(chan *amqp.Error, 1))
+		acknowledger := newSessionAcknowledger(sub.Channel, sub.Close)
 
-		log.Printf("publishing exchange %s", exchangeName)
+		log.Printf("subscribed queues %s", strings.Join(queueNames, ","))
 
-	Publish:
+	Consume:
 		for {
-			var body dto.Message
 			select {
-			case confirmed, ok := <-confirm:
+			case msg, ok := <-msgs:
 				if !ok {
-					break Publish
-				}
-				if !confirmed.Ack {
-					log.Printf("nack message %d, body: %q", confirmed.DeliveryTag, string(body))
+					log.Printf("consumers of queues %s cancelled", strings.Join(queueNames, ","))
+					acknowledger.retire()
+					break Consume
 				}
-				reading = messages
-
-			case body = <-pending:
-				routingKey := "ignored for fanout exchanges, application dependent for other exchanges"
-				err := pub.Publish(exchangeName, routingKey, false, false, amqp.Publishing{
-					Body: body,
-				})
-				// Retry failed delivery on the next session
-				if err != nil {
-					pending <- body
-					pub.Close()
-					break Publish
-				}
-
-			case body, running = <-reading:
-				// all messages consumed
-				if !running {
+				acknowledger.deliver()
+				delivery := brokerService.NewDelivery(msg.Body, msg.Headers, msg.RoutingKey, msg.DeliveryTag, msg.Redelivered, acknowledger)
+				select {
+				case deliveries <- delivery:
+				case <-ctx.Done():
+					delivery.Nack(true)
+					cancelConsumers(sub, tags, msgs)
+					acknowledger.retire()
 					return
 				}
-				// work on pending delivery until ack'd
-				pending <- body
-				reading = nil
+			case err := <-closed:
+				log.Printf("connection closed, queues %s: %v", strings.Join(queueNames, ","), err)
+				// deliveries of the closed connection are requeued by the broker
+				go func() {
+					for range msgs {
+					}
+				}()
+				break Consume
+			case <-ctx.Done():
+				cancelConsumers(sub, tags, msgs)
+				acknowledger.retire()
+				return
 			}
 		}
 	}
 }
 
-func Subscribe(sessions chan chan session, messages chan<- dto.Message, queueName string) {
-	for session := range sessions {
-		sub := <-session
-
+// consume starts a consumer of each queue and merges their deliveries. The prefetch limit is set for the channel,
+// so it is shared by all the consumers.
+func consume(sub session, queueNames []string, prefetch int) (<-chan amqp.Delivery, []string, error) {
+	if err := sub.Channel.Qos(prefetch, 0, true); err != nil {
+		return nil, nil, fmt.Errorf("could not configure QoS: %s", err)
+	}
+	var consumers []<-chan amqp.Delivery
+	var tags []string
+	for _, queueName := range queueNames {
 		if _, err := sub.QueueDeclare(queueName, true, false, false, false, nil); err != nil {
-			log.Printf("cannot consume from queue: %s, %s", queueName, err)
-			return
+			return nil, nil, err
+		}
+		tag := consumerTag(queueName)
+		msgs, err := sub.Consume(queueName, tag, false, false, false, false, nil)
+		if err != nil {
+			return nil, nil, err
 		}
+		consumers = append(consumers, msgs)
+		tags = append(tags, tag)
+	}
+
+	merged := make(chan amqp.Delivery)
+	var forwarding sync.WaitGroup
+	forwarding.Add(len(consumers))
+	for _, msgs := range consumers {
+		go func(msgs <-chan amqp.Delivery) {
+			defer forwarding.Done()
+			for msg := range msgs {
+				merged <- msg
+			}
+		}(msgs)
+	}
+	go func() {
+		forwarding.Wait()
+		close(merged)
+	}()
+	return merged, tags, nil
+}
 
-		if err := sub.Channel.Qos(1, 0, false); err != nil {
-			log.Printf("Could not configure QoS: %s, %s", queueName, err)
+// SubscribeExchange consumes messages of a fanout exchange through an exclusive, auto-deleted queue,
+// so every subscriber receives all messages published to the exchange. It returns when ctx is cancelled.
+func SubscribeExchange(ctx context.Context, sessions chan chan session, messages chan<- dto.Message, exchangeName string) {
+	for session := range sessions {
+		sub, ok := <-session
+		if !ok {
 			return
 		}
 
-		deliveries, err := sub.Consume(queueName, "", false, false, false, false, nil)
+		msgs, err := consumeExchange(sub, exchangeName)
 		if err != nil {
-			log.Printf("cannot consume from: %s, %s", queueName, err)
-			return
+			log.Printf("cannot consume from exchange: %s, %s", exchangeName, err)
+			sub.Close()
+			continue
+		}
+
+		log.Printf("subscribed exchange %s", exchangeName)
+
+	Consume:
+		for {
+			select {
+			case msg, ok := <-msgs:
+				if !ok {
+					log.Printf("subscription of exchange %s closed", exchangeName)
+					sub.Close()
+					break Consume
+				}
+				select {
+				case messages <- msg.Body:
+				case <-ctx.Done():
+					sub.Close()
+					return
+				}
+			case <-ctx.Done():
+				sub.Close()
+				return
+			}
 		}
+	}
+}
 
-		log.Printf("subscribed queue %s", queueName)
+func consumeExchange(sub session, exchangeName string) (<-chan amqp.Delivery, error) {
+	if err := sub.ExchangeDeclare(exchangeName, "fanout", true, false, false, false, nil); err != nil {
+		return nil, err
+	}
+	queue, err := sub.QueueDeclare("", false, true, true, false, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := sub.QueueBind(queue.Name, "", exchangeName, false, nil); err != nil {
+		return nil, err
+	}
+	return sub.Consume(queue.Name, "", true, true, false, false, nil)
+}
 
-		for msg := range deliveries {
-			messages <- msg.Body
-			sub.Ack(msg.DeliveryTag, false)
+// cancelConsumers stops the consumers and requeues messages prefetched in the meantime.
+func cancelConsumers(sub session, tags []string, msgs <-chan amqp.Delivery) {
+	cancelled := true
+	for _, tag := range tags {
+		log.Printf("cancelling consumer %s", tag)
+		if err := sub.Cancel(tag, false); err != nil {
+			log.Printf("cannot cancel consumer: %s, %s", tag, err)
+			cancelled = false
+		}
+	}
+	requeue := func() {
+		for msg := range msgs {
+			msg.Nack(false, true)
 		}
 	}
+	if !cancelled {
+		// deliveries end when the connection is closed
+		go requeue()
+		return
+	}
+	requeue()
+}
+
+func consumerTag(queueName string) string {
+	hostname, _ := os.Hostname()
+	return fmt.Sprintf("%s-%s-%d", queueName, hostname, os.Getpid())
 }
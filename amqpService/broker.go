@@ -0,0 +1,111 @@
+package amqpService
+
+import (
+	"github.com/deploji/deploji-server/dto"
+	"github.com/deploji/deploji-worker/brokerService"
+	"github.com/deploji/deploji-worker/utils"
+	"golang.org/x/net/context"
+	"log"
+	"time"
+)
+
+var _ brokerService.Broker = &Broker{}
+
+// Broker is a brokerService.Broker backed by RabbitMQ.
+type Broker struct {
+	url         string
+	ctx         context.Context
+	cancel      context.CancelFunc
+	jobStatuses chan dto.Message
+	jobLogs     chan JobLog
+	deadLetters chan brokerService.DeadLetter
+	heartbeats  chan dto.Message
+	published   []chan struct{}
+}
+
+// NewBroker starts publishers of job statuses, logs, dead letters and heartbeats, each using its own connection.
+func NewBroker(url string) *Broker {
+	ctx, cancel := context.WithCancel(context.Background())
+	b := &Broker{
+		url:         url,
+		ctx:         ctx,
+		cancel:      cancel,
+		jobStatuses: make(chan dto.Message),
+		jobLogs:     make(chan JobLog),
+		deadLetters: make(chan brokerService.DeadLetter),
+		heartbeats:  make(chan dto.Message),
+	}
+	b.publish(func() {
+		Publish(Redial(ctx, url), b.jobStatuses, "job_statuses")
+	})
+	b.publish(func() {
+		PublishJobLogs(Redial(ctx, url), b.jobLogs, "job_logs", utils.GetEnvInt("AMQP_LOG_CHANNELS", 4))
+	})
+	b.publish(func() {
+		PublishDeadLetters(Redial(ctx, url), b.deadLetters, "jobs_dead_letter")
+	})
+	b.publish(func() {
+		Publish(Redial(ctx, url), b.heartbeats, "worker_heartbeats")
+	})
+	return b
+}
+
+func (b *Broker) publish(publisher func()) {
+	published := make(chan struct{})
+	b.published = append(b.published, published)
+	go func() {
+		publisher()
+		close(published)
+	}()
+}
+
+func (b *Broker) SubscribeJobs(ctx context.Context, queueNames []string, prefetch int, deliveries chan<- *brokerService.Delivery) {
+	Subscribe(ctx, Redial(ctx, b.url), deliveries, queueNames, prefetch)
+}
+
+func (b *Broker) SubscribeControl(ctx context.Context, messages chan<- dto.Message) {
+	SubscribeExchange(ctx, Redial(ctx, b.url), messages, "job_control")
+}
+
+func (b *Broker) PublishStatus(message dto.Message) {
+	b.jobStatuses <- message
+}
+
+func (b *Broker) PublishLog(jobID uint, message dto.Message) {
+	b.jobLogs <- JobLog{JobID: jobID, Body: message}
+}
+
+func (b *Broker) PublishEvent(jobID uint, message dto.Message) {
+	b.jobLogs <- JobLog{JobID: jobID, Body: message, Event: true}
+}
+
+func (b *Broker) PublishDeadLetter(deadLetter brokerService.DeadLetter) {
+	b.deadLetters <- deadLetter
+}
+
+func (b *Broker) PublishHeartbeat(message dto.Message) {
+	b.heartbeats <- message
+}
+
+// DeleteUnusedExchanges deletes given exchanges if they have no bindings.
+func (b *Broker) DeleteUnusedExchanges(exchangeNames []string) error {
+	ctx, cancel := context.WithCancel(b.ctx)
+	defer cancel()
+	return DeleteUnusedExchanges(Redial(ctx, b.url), exchangeNames)
+}
+
+func (b *Broker) Close(timeout time.Duration) {
+	close(b.jobStatuses)
+	close(b.jobLogs)
+	close(b.deadLetters)
+	close(b.heartbeats)
+	deadline := time.Now().Add(timeout)
+	for _, published := range b.published {
+		select {
+		case <-published:
+		case <-time.After(time.Until(deadline)):
+			log.Println("timeout publishing pending messages")
+		}
+	}
+	b.cancel()
+}
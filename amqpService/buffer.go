@@ -0,0 +1,44 @@
+package amqpService
+
+import (
+	"log"
+)
+
+// bufferWarnSize is the number of buffered messages above which the buffer growth is logged.
+const bufferWarnSize = 1000
+
+// buffer decouples producers from the publisher. Messages are queued in memory while the broker
+// is unavailable, so producers such as running jobs are never blocked by a lost connection.
+// The returned channel is closed after in is closed and all buffered messages are read.
+func buffer(in <-chan publishing) <-chan publishing {
+	out := make(chan publishing)
+	go func() {
+		defer close(out)
+		var queue []publishing
+		for in != nil || len(queue) > 0 {
+			var (
+				send chan<- publishing
+				next publishing
+			)
+			if len(queue) > 0 {
+				send = out
+				next = queue[0]
+			}
+			select {
+			case msg, ok := <-in:
+				if !ok {
+					in = nil
+					continue
+				}
+				queue = append(queue, msg)
+				if len(queue)%bufferWarnSize == 0 {
+					log.Printf("%d messages waiting for the broker", len(queue))
+				}
+			case send <- next:
+				queue[0] = publishing{}
+				queue = queue[1:]
+			}
+		}
+	}()
+	return out
+}
@@ -0,0 +1,293 @@
+package amqpService
+
+import (
+	"fmt"
+	"github.com/deploji/deploji-server/dto"
+	"github.com/deploji/deploji-worker/brokerService"
+	"github.com/streadway/amqp"
+	"log"
+	"sync"
+	"time"
+)
+
+// publishing is a message together with the routing key it is published with.
+type publishing struct {
+	routingKey string
+	amqp.Publishing
+}
+
+// publish publishes messages to a reconnecting session to a fanout exchange.
+// It receives from the application specific source of messages.
+func Publish(sessions chan chan session, messages <-chan dto.Message, exchangeName string) {
+	publishings := make(chan publishing)
+	go func() {
+		defer close(publishings)
+		for body := range messages {
+			publishings <- publishing{Publishing: amqp.Publishing{Body: body}}
+		}
+	}()
+	publish(sessions, publishings, exchangeName, func(ch *amqp.Channel) error {
+		return ch.ExchangeDeclare(exchangeName, "fanout", true, false, false, false, nil)
+	})
+}
+
+// PublishDeadLetters publishes messages rejected by the application to a durable fanout exchange
+// bound to a durable queue of the same name, so they are kept until an operator inspects or replays them.
+func PublishDeadLetters(sessions chan chan session, deadLetters <-chan brokerService.DeadLetter, exchangeName string) {
+	publishings := make(chan publishing)
+	go func() {
+		defer close(publishings)
+		for deadLetter := range deadLetters {
+			headers := amqp.Table{}
+			for key, value := range deadLetter.Headers {
+				headers[key] = value
+			}
+			headers["x-deploji-reason"] = deadLetter.Reason
+			headers["x-deploji-routing-key"] = deadLetter.RoutingKey
+			publishings <- publishing{Publishing: amqp.Publishing{
+				Headers:      headers,
+				DeliveryMode: amqp.Persistent,
+				Timestamp:    time.Now(),
+				Body:         deadLetter.Body,
+			}}
+		}
+	}()
+	publish(sessions, publishings, exchangeName, func(ch *amqp.Channel) error {
+		if err := ch.ExchangeDeclare(exchangeName, "fanout", true, false, false, false, nil); err != nil {
+			return err
+		}
+		if _, err := ch.QueueDeclare(exchangeName, true, false, false, false, nil); err != nil {
+			return err
+		}
+		return ch.QueueBind(exchangeName, "", exchangeName, false, nil)
+	})
+}
+
+// PublishJobLogs publishes logs of all jobs to a topic exchange using one connection with a pool of channels.
+// Logs of a job are always published on the same channel, so they are received in order.
+func PublishJobLogs(sessions chan chan session, logs <-chan JobLog, exchangeName string, channels int) {
+	if channels < 1 {
+		channels = 1
+	}
+	shards := make([]chan publishing, channels)
+	publishers := make([]*publisher, channels)
+	for i := range shards {
+		shards[i] = make(chan publishing)
+		publishers[i] = &publisher{exchangeName: exchangeName, messages: buffer(shards[i])}
+	}
+	go func() {
+		defer func() {
+			for _, shard := range shards {
+				close(shard)
+			}
+		}()
+		for jobLog := range logs {
+			shards[jobLog.JobID%uint(channels)] <- publishing{
+				routingKey: jobLog.routingKey(),
+				Publishing: amqp.Publishing{Body: jobLog.Body},
+			}
+		}
+	}()
+
+	finished := make([]bool, channels)
+	for session := range sessions {
+		pub, ok := <-session
+		if !ok {
+			return
+		}
+
+		if err := pub.Channel.ExchangeDeclare(exchangeName, "topic", true, false, false, false, nil); err != nil {
+			log.Printf("cannot declare exchange: %s, %v", exchangeName, err)
+			pub.Close()
+			continue
+		}
+
+		log.Printf("publishing exchange %s on %d channels", exchangeName, channels)
+
+		// All channels are opened before publishing, a failure closes the session so every shard
+		// is restarted on the next one.
+		chs, err := openChannels(pub.Channel, pub.Connection.Channel, finished)
+		if err != nil {
+			log.Printf("cannot create channel: %v", err)
+			pub.Close()
+			continue
+		}
+
+		var wg sync.WaitGroup
+		for i, ch := range chs {
+			if ch == nil {
+				continue
+			}
+			wg.Add(1)
+			go func(i int, ch *amqp.Channel) {
+				defer wg.Done()
+				finished[i] = publishers[i].run(ch)
+				// A failed channel fails the whole session, so all channels are recreated on the next one.
+				if !finished[i] {
+					pub.Close()
+				}
+			}(i, ch)
+		}
+		wg.Wait()
+		pub.Close()
+
+		if allFinished(finished) {
+			return
+		}
+	}
+}
+
+// openChannels returns a channel for every publisher which has not finished, nil for the finished ones.
+// The first publisher uses the session channel, the others get channels opened by open.
+func openChannels(first *amqp.Channel, open func() (*amqp.Channel, error), finished []bool) ([]*amqp.Channel, error) {
+	chs := make([]*amqp.Channel, len(finished))
+	for i := range finished {
+		if finished[i] {
+			continue
+		}
+		if i == 0 {
+			chs[i] = first
+			continue
+		}
+		ch, err := open()
+		if err != nil {
+			return nil, err
+		}
+		chs[i] = ch
+	}
+	return chs, nil
+}
+
+func allFinished(finished []bool) bool {
+	for _, f := range finished {
+		if !f {
+			return false
+		}
+	}
+	return true
+}
+
+// publish publishes messages to a reconnecting session, using a single channel.
+func publish(sessions chan chan session, messages <-chan publishing, exchangeName string, declare func(ch *amqp.Channel) error) {
+	pub := &publisher{exchangeName: exchangeName, messages: buffer(messages)}
+
+	for session := range sessions {
+		sess, ok := <-session
+		if !ok {
+			return
+		}
+
+		if err := declare(sess.Channel); err != nil {
+			log.Printf("cannot declare exchange: %s, %v", exchangeName, err)
+			sess.Close()
+			continue
+		}
+
+		log.Printf("publishing exchange %s", exchangeName)
+
+		finished := pub.run(sess.Channel)
+		sess.Close()
+		if finished {
+			return
+		}
+	}
+}
+
+// publisher publishes messages to the exchange, keeping the unconfirmed message between channels.
+type publisher struct {
+	exchangeName string
+	messages     <-chan publishing
+	pending      publishing
+	awaiting     bool
+}
+
+// run publishes messages on the channel. It returns true when all messages were consumed and false when
+// the channel failed. A message is not read from the source until the previous one is confirmed,
+// an unconfirmed message is published again on the next channel.
+func (p *publisher) run(ch *amqp.Channel) bool {
+	// publisher confirms for this channel/connection
+	confirm := make(chan amqp.Confirmation, 1)
+	confirms := ch.Confirm(false) == nil
+	if confirms {
+		ch.NotifyPublish(confirm)
+	} else {
+		log.Printf("publisher confirms not supported")
+	}
+	closed := ch.NotifyClose(make(chan *amqp.Error, 1))
+
+	if p.awaiting {
+		if err := p.send(ch); err != nil {
+			return false
+		}
+		p.awaiting = confirms
+	}
+
+	for {
+		reading := p.messages
+		if p.awaiting {
+			reading = nil
+		}
+		select {
+		case confirmed := <-confirm:
+			if !confirmed.Ack {
+				log.Printf("nack message %d, body: %q", confirmed.DeliveryTag, string(p.pending.Body))
+			}
+			p.awaiting = false
+
+		case err := <-closed:
+			log.Printf("channel closed, exchange %s: %v", p.exchangeName, err)
+			return false
+
+		case body, running := <-reading:
+			// all messages consumed
+			if !running {
+				return true
+			}
+			p.pending = body
+			p.awaiting = true
+			// Retry failed delivery on the next channel
+			if err := p.send(ch); err != nil {
+				return false
+			}
+			// work on pending delivery until ack'd
+			p.awaiting = confirms
+		}
+	}
+}
+
+func (p *publisher) send(ch *amqp.Channel) error {
+	routingKey := p.pending.routingKey
+	if routingKey == "" {
+		routingKey = "ignored for fanout exchanges, application dependent for other exchanges"
+	}
+	return ch.Publish(p.exchangeName, routingKey, false, false, p.pending.Publishing)
+}
+
+// DeleteUnusedExchanges deletes exchanges that have no bindings, exchanges in use are kept.
+// It is used to remove exchanges declared by previous versions of the worker, an error is returned
+// when not all the exchanges were processed.
+func DeleteUnusedExchanges(sessions chan chan session, exchangeNames []string) error {
+	session, ok := <-sessions
+	if !ok {
+		return fmt.Errorf("no session")
+	}
+	sess, ok := <-session
+	if !ok {
+		return fmt.Errorf("no session")
+	}
+	defer sess.Close()
+
+	ch := sess.Channel
+	kept := 0
+	for _, name := range exchangeNames {
+		if err := ch.ExchangeDelete(name, true, false); err != nil {
+			kept++
+			// The failed command closes the channel, continue on a new one.
+			if ch, err = sess.Connection.Channel(); err != nil {
+				return fmt.Errorf("cannot create channel: %v", err)
+			}
+		}
+	}
+	log.Printf("deleted unused exchanges, %d of %d kept", kept, len(exchangeNames))
+	return nil
+}
@@ -0,0 +1,44 @@
+package amqpService
+
+import (
+	"errors"
+	"github.com/streadway/amqp"
+	"testing"
+)
+
+func TestOpenChannels(t *testing.T) {
+	first := &amqp.Channel{}
+	opened := 0
+	open := func() (*amqp.Channel, error) {
+		opened++
+		return &amqp.Channel{}, nil
+	}
+	chs, err := openChannels(first, open, []bool{false, true, false})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if chs[0] != first || chs[1] != nil || chs[2] == nil || chs[2] == first {
+		t.Errorf("unexpected channels: %v", chs)
+	}
+	if opened != 1 {
+		t.Errorf("expected 1 opened channel, got %d", opened)
+	}
+}
+
+func TestOpenChannelsFailure(t *testing.T) {
+	opened := 0
+	open := func() (*amqp.Channel, error) {
+		opened++
+		if opened == 2 {
+			return nil, errors.New("channel limit reached")
+		}
+		return &amqp.Channel{}, nil
+	}
+	chs, err := openChannels(&amqp.Channel{}, open, make([]bool, 4))
+	if err == nil {
+		t.Fatalf("expected an error, got channels %v", chs)
+	}
+	if opened != 2 {
+		t.Errorf("expected opening to stop at the failure, opened %d", opened)
+	}
+}
@@ -0,0 +1,128 @@
+# Emits Ansible events as JSON lines to the file descriptor given by DEPLOJI_EVENTS_FD,
+# the Deploji worker parses them into job events. The worker copies the plugin next to the playbook,
+# it does not need to be enabled, so callbacks configured by the project are kept.
+from __future__ import (absolute_import, division, print_function)
+__metaclass__ = type
+
+DOCUMENTATION = '''
+    callback: deploji_events
+    type: notification
+    short_description: Emits JSON events for the Deploji worker
+    description:
+      - Writes one JSON object per line to the file descriptor given by the DEPLOJI_EVENTS_FD environment variable.
+'''
+
+import datetime
+import json
+import os
+
+from ansible.parsing.ajson import AnsibleJSONEncoder
+from ansible.plugins.callback import CallbackBase
+
+
+class CallbackModule(CallbackBase):
+    CALLBACK_VERSION = 2.0
+    CALLBACK_TYPE = 'notification'
+    CALLBACK_NAME = 'deploji_events'
+    CALLBACK_NEEDS_WHITELIST = False
+    CALLBACK_NEEDS_ENABLED = False
+
+    def __init__(self):
+        super(CallbackModule, self).__init__()
+        self._out = None
+        self._playbook = None
+        self._play = None
+        fd = os.environ.get('DEPLOJI_EVENTS_FD')
+        if fd:
+            fd = int(fd)
+            # Modules and connection plugins must not keep the pipe open after the playbook exits.
+            if hasattr(os, 'set_inheritable'):
+                os.set_inheritable(fd, False)
+            self._out = os.fdopen(fd, 'w')
+
+    def _emit(self, event, **data):
+        if self._out is None:
+            return
+        data['event'] = event
+        data['timestamp'] = datetime.datetime.utcnow().strftime('%Y-%m-%dT%H:%M:%S.%fZ')
+        if self._playbook:
+            data.setdefault('playbook', self._playbook)
+        if self._play:
+            data.setdefault('play', self._play)
+        try:
+            self._out.write(json.dumps(data, cls=AnsibleJSONEncoder) + '\n')
+            self._out.flush()
+        except (IOError, OSError, ValueError, TypeError) as e:
+            self._display.warning('deploji_events: cannot emit %s: %s' % (event, e))
+
+    def _result(self, event, result, **data):
+        task_result = dict(result._result)
+        self._clean_results(task_result, result._task.action)
+        self._emit(
+            event,
+            task=result._task.get_name(),
+            task_action=result._task.action,
+            host=result._host.get_name(),
+            changed=bool(task_result.get('changed', False)),
+            result=task_result,
+            **data
+        )
+
+    def v2_playbook_on_start(self, playbook):
+        self._playbook = os.path.basename(playbook._file_name)
+        self._emit('playbook_on_start')
+
+    def v2_playbook_on_play_start(self, play):
+        self._play = play.get_name()
+        self._emit('playbook_on_play_start')
+
+    def v2_playbook_on_task_start(self, task, is_conditional):
+        self._emit('playbook_on_task_start', task=task.get_name(), task_action=task.action)
+
+    def v2_playbook_on_handler_task_start(self, task):
+        self._emit('playbook_on_handler_task_start', task=task.get_name(), task_action=task.action)
+
+    def v2_runner_on_ok(self, result):
+        self._result('runner_on_ok', result)
+
+    def v2_runner_on_failed(self, result, ignore_errors=False):
+        self._result('runner_on_failed', result, ignore_errors=ignore_errors)
+
+    def v2_runner_on_unreachable(self, result):
+        self._result('runner_on_unreachable', result)
+
+    def v2_runner_on_skipped(self, result):
+        self._result('runner_on_skipped', result)
+
+    def v2_runner_item_on_ok(self, result):
+        self._result('runner_item_on_ok', result)
+
+    def v2_runner_item_on_failed(self, result):
+        self._result('runner_item_on_failed', result)
+
+    def v2_runner_item_on_skipped(self, result):
+        self._result('runner_item_on_skipped', result)
+
+    def v2_on_file_diff(self, result):
+        diff = result._result.get('diff')
+        if not diff and result._result.get('results'):
+            diff = [r['diff'] for r in result._result['results'] if r.get('diff')]
+        if not diff:
+            return
+        self._emit(
+            'on_file_diff',
+            task=result._task.get_name(),
+            task_action=result._task.action,
+            host=result._host.get_name(),
+            changed=bool(result._result.get('changed', False)),
+            diff=diff,
+        )
+
+    def v2_playbook_on_stats(self, stats):
+        hosts = {}
+        for host in sorted(stats.processed.keys()):
+            hosts[host] = stats.summarize(host)
+        self._emit('playbook_on_stats', stats=hosts)
+        if self._out is not None:
+            self._out.close()
+            self._out = None
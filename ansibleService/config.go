@@ -0,0 +1,43 @@
+package ansibleService
+
+import (
+	"regexp"
+	"strings"
+)
+
+// ConfigDump is the effective Ansible configuration printed by ansible-config dump,
+// raw values are keyed by setting names, e.g. DEFAULT_ROLES_PATH.
+type ConfigDump map[string]string
+
+// configDumpLine matches "NAME(origin) = value" lines of ansible-config dump.
+var configDumpLine = regexp.MustCompile(`^([A-Z0-9_]+)\((.*?)\) = (.*)$`)
+
+// ParseConfigDump parses the output of ansible-config dump. It has to be printed without colors.
+func ParseConfigDump(output string) ConfigDump {
+	config := ConfigDump{}
+	for _, line := range strings.Split(output, "\n") {
+		if match := configDumpLine.FindStringSubmatch(strings.TrimSpace(line)); match != nil {
+			config[match[1]] = match[3]
+		}
+	}
+	return config
+}
+
+// Paths returns the value of a path list setting, e.g. ['/etc/ansible/roles', '/srv/roles'].
+// The second result is false when the setting is not in the dump.
+func (c ConfigDump) Paths(name string) ([]string, bool) {
+	value, ok := c[name]
+	if !ok {
+		return nil, false
+	}
+	value = strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(value), "["), "]")
+	paths := make([]string, 0)
+	for _, path := range strings.Split(value, ", ") {
+		path = strings.TrimPrefix(strings.TrimSpace(path), "u")
+		path = strings.Trim(path, `'"`)
+		if path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return paths, true
+}
@@ -0,0 +1,28 @@
+package ansibleService
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestConfigDumpPaths(t *testing.T) {
+	config := ParseConfigDump(`ANSIBLE_FORCE_COLOR(env: ANSIBLE_FORCE_COLOR) = False
+COLLECTIONS_PATHS(default) = ['/root/.ansible/collections', '/usr/share/ansible/collections']
+DEFAULT_ROLES_PATH(/storage/workspaces/12/ansible.cfg) = ['/storage/workspaces/12/vendor/roles', '/etc/ansible/roles']
+DEFAULT_VAULT_IDENTITY_LIST(default) = []
+`)
+	roles, ok := config.Paths("DEFAULT_ROLES_PATH")
+	if expected := []string{"/storage/workspaces/12/vendor/roles", "/etc/ansible/roles"}; !ok || !reflect.DeepEqual(roles, expected) {
+		t.Errorf("expected %v, got %v", expected, roles)
+	}
+	collections, ok := config.Paths("COLLECTIONS_PATHS")
+	if expected := []string{"/root/.ansible/collections", "/usr/share/ansible/collections"}; !ok || !reflect.DeepEqual(collections, expected) {
+		t.Errorf("expected %v, got %v", expected, collections)
+	}
+	if paths, ok := config.Paths("DEFAULT_VAULT_IDENTITY_LIST"); !ok || len(paths) != 0 {
+		t.Errorf("expected empty list, got %v", paths)
+	}
+	if _, ok := config.Paths("COLLECTIONS_PATH"); ok {
+		t.Error("expected missing setting")
+	}
+}
@@ -0,0 +1,78 @@
+package ansibleService
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// EventFileDiff is emitted for tasks reporting a diff, when ansible-playbook runs with --diff.
+const EventFileDiff EventType = "on_file_diff"
+
+// FileDiff is a single diff reported by a task. Modules report either the content before and after the change
+// or a prepared diff.
+type FileDiff struct {
+	BeforeHeader string
+	AfterHeader  string
+	Before       string
+	After        string
+	Prepared     string
+}
+
+type rawFileDiff struct {
+	BeforeHeader string          `json:"before_header"`
+	AfterHeader  string          `json:"after_header"`
+	Before       json.RawMessage `json:"before"`
+	After        json.RawMessage `json:"after"`
+	Prepared     string          `json:"prepared"`
+}
+
+// Diffs decodes diffs of an on_file_diff event. Tasks with loops report a list of diffs, which is flattened.
+func (e *Event) Diffs() ([]FileDiff, error) {
+	return decodeDiffs(e.Diff)
+}
+
+func decodeDiffs(data json.RawMessage) ([]FileDiff, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 || bytes.Equal(data, []byte("null")) {
+		return nil, nil
+	}
+	if data[0] == '[' {
+		var items []json.RawMessage
+		if err := json.Unmarshal(data, &items); err != nil {
+			return nil, err
+		}
+		var diffs []FileDiff
+		for _, item := range items {
+			itemDiffs, err := decodeDiffs(item)
+			if err != nil {
+				return nil, err
+			}
+			diffs = append(diffs, itemDiffs...)
+		}
+		return diffs, nil
+	}
+	raw := rawFileDiff{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	return []FileDiff{{
+		BeforeHeader: raw.BeforeHeader,
+		AfterHeader:  raw.AfterHeader,
+		Before:       diffContent(raw.Before),
+		After:        diffContent(raw.After),
+		Prepared:     raw.Prepared,
+	}}, nil
+}
+
+// diffContent returns the content of a diff side. Most modules report it as a string, others as structured data,
+// which is kept as JSON.
+func diffContent(data json.RawMessage) string {
+	if len(data) == 0 || bytes.Equal(data, []byte("null")) {
+		return ""
+	}
+	var content string
+	if err := json.Unmarshal(data, &content); err == nil {
+		return content
+	}
+	return string(data)
+}
@@ -0,0 +1,32 @@
+package ansibleService
+
+import (
+	"testing"
+)
+
+func TestEventDiffs(t *testing.T) {
+	event, err := ParseEvent([]byte(`{"event": "on_file_diff", "task": "Configure nginx", "host": "web1", "diff": [
+		{"before_header": "/etc/nginx/nginx.conf", "after_header": "/etc/nginx/nginx.conf", "before": "worker_processes 1;\n", "after": "worker_processes 4;\n"},
+		[{"prepared": "--- before\n+++ after\n"}, {"before": {"state": "absent"}, "after": {"state": "directory"}}]
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	diffs, err := event.Diffs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []FileDiff{
+		{BeforeHeader: "/etc/nginx/nginx.conf", AfterHeader: "/etc/nginx/nginx.conf", Before: "worker_processes 1;\n", After: "worker_processes 4;\n"},
+		{Prepared: "--- before\n+++ after\n"},
+		{Before: `{"state": "absent"}`, After: `{"state": "directory"}`},
+	}
+	if len(diffs) != len(expected) {
+		t.Fatalf("expected %d diffs, got %d: %+v", len(expected), len(diffs), diffs)
+	}
+	for i, diff := range diffs {
+		if diff != expected[i] {
+			t.Errorf("expected %+v, got %+v", expected[i], diff)
+		}
+	}
+}
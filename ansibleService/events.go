@@ -0,0 +1,119 @@
+package ansibleService
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// EventType is the name of the callback emitting the event.
+type EventType string
+
+const (
+	EventPlaybookStart     EventType = "playbook_on_start"
+	EventPlayStart         EventType = "playbook_on_play_start"
+	EventTaskStart         EventType = "playbook_on_task_start"
+	EventHandlerTaskStart  EventType = "playbook_on_handler_task_start"
+	EventRunnerOk          EventType = "runner_on_ok"
+	EventRunnerFailed      EventType = "runner_on_failed"
+	EventRunnerUnreachable EventType = "runner_on_unreachable"
+	EventRunnerSkipped     EventType = "runner_on_skipped"
+	EventRunnerItemOk      EventType = "runner_item_on_ok"
+	EventRunnerItemFailed  EventType = "runner_item_on_failed"
+	EventRunnerItemSkipped EventType = "runner_item_on_skipped"
+	EventStats             EventType = "playbook_on_stats"
+)
+
+// Event is a structured Ansible event emitted by the deploji_events callback plugin.
+type Event struct {
+	JobID        uint            `json:"job_id"`
+	Event        EventType       `json:"event"`
+	Timestamp    time.Time       `json:"timestamp"`
+	Playbook     string          `json:"playbook,omitempty"`
+	Play         string          `json:"play,omitempty"`
+	Task         string          `json:"task,omitempty"`
+	TaskAction   string          `json:"task_action,omitempty"`
+	Host         string          `json:"host,omitempty"`
+	Changed      bool            `json:"changed,omitempty"`
+	IgnoreErrors bool            `json:"ignore_errors,omitempty"`
+	Result       json.RawMessage `json:"result,omitempty"`
+	Stats        json.RawMessage `json:"stats,omitempty"`
+	Diff         json.RawMessage `json:"diff,omitempty"`
+}
+
+// CallbackPluginName is the name of the callback plugin emitting events.
+const CallbackPluginName = "deploji_events"
+
+// callbackPluginDir is the directory of callback plugins shipped with the worker, relative to its working directory.
+var callbackPluginDir = "./ansible/callback_plugins"
+
+// eventsFdVariable is the environment variable with the file descriptor the callback plugin writes events to.
+const eventsFdVariable = "DEPLOJI_EVENTS_FD"
+
+// maxEventSize limits the size of a single event. Events following a larger one are discarded.
+const maxEventSize = 4 * 1024 * 1024
+
+// EventsEnv returns environment variables of the callback plugin, which writes events to the file descriptor fd
+// of the ansible-playbook process.
+func EventsEnv(fd int) []string {
+	return []string{fmt.Sprintf("%s=%d", eventsFdVariable, fd)}
+}
+
+// InstallCallbackPlugin copies the callback plugin into the callback_plugins directory adjacent to the playbook.
+// Ansible loads plugins adjacent to playbooks in addition to the ones configured by the project, and the plugin
+// does not need to be enabled, so callback settings of the project are kept.
+func InstallCallbackPlugin(workspace string, playbook string) error {
+	dir := filepath.Join(workspace, filepath.Dir(playbook), "callback_plugins")
+	if relative, err := filepath.Rel(workspace, dir); err != nil || relative == ".." || strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("playbook %s is outside of the workspace", playbook)
+	}
+	if info, err := os.Lstat(dir); err == nil && !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	plugin, err := ioutil.ReadFile(filepath.Join(callbackPluginDir, CallbackPluginName+".py"))
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, CallbackPluginName+".py"), plugin, 0644)
+}
+
+// ParseEvent decodes an event written by the callback plugin.
+func ParseEvent(line []byte) (*Event, error) {
+	event := &Event{}
+	if err := json.Unmarshal(line, event); err != nil {
+		return nil, err
+	}
+	if event.Event == "" {
+		return nil, fmt.Errorf("missing event type")
+	}
+	return event, nil
+}
+
+// ReadEvents parses events from r, one per line, and passes them to handle until r is drained.
+// Lines which cannot be parsed are logged and skipped.
+func ReadEvents(r io.Reader, handle func(event *Event)) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxEventSize)
+	for scanner.Scan() {
+		event, err := ParseEvent(scanner.Bytes())
+		if err != nil {
+			log.Printf("Cannot parse Ansible event: %s", err)
+			continue
+		}
+		handle(event)
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("Cannot read Ansible events: %s", err)
+		io.Copy(ioutil.Discard, r)
+	}
+}
@@ -0,0 +1,68 @@
+package ansibleService
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadEvents(t *testing.T) {
+	output := strings.Join([]string{
+		`{"event": "playbook_on_task_start", "timestamp": "2020-10-01T12:00:00.000000Z", "play": "web", "task": "Install nginx", "task_action": "apt"}`,
+		`not an event`,
+		`{"event": "runner_on_ok", "timestamp": "2020-10-01T12:00:01.500000Z", "play": "web", "task": "Install nginx", "host": "web1", "changed": true, "result": {"changed": true}}`,
+		`{"event": "playbook_on_stats", "timestamp": "2020-10-01T12:00:02.000000Z", "stats": {"web1": {"ok": 1, "changed": 1}}}`,
+	}, "\n")
+
+	var events []*Event
+	ReadEvents(strings.NewReader(output), func(event *Event) {
+		events = append(events, event)
+	})
+
+	if len(events) != 3 {
+		t.Fatalf("expected 3 events, got %d", len(events))
+	}
+	ok := events[1]
+	if ok.Event != EventRunnerOk || ok.Host != "web1" || ok.Task != "Install nginx" || !ok.Changed {
+		t.Errorf("unexpected event %+v", ok)
+	}
+	if ok.Timestamp.Nanosecond() != 500000000 {
+		t.Errorf("unexpected timestamp %s", ok.Timestamp)
+	}
+	if events[2].Event != EventStats || len(events[2].Stats) == 0 {
+		t.Errorf("unexpected stats event %+v", events[2])
+	}
+}
+
+func TestParseEventRequiresType(t *testing.T) {
+	if _, err := ParseEvent([]byte(`{"host": "web1"}`)); err == nil {
+		t.Error("expected error for event without type")
+	}
+}
+
+func TestInstallCallbackPlugin(t *testing.T) {
+	callbackPluginDir = "../ansible/callback_plugins"
+	workspace, err := ioutil.TempDir("", "workspace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workspace)
+
+	if err := InstallCallbackPlugin(workspace, "playbooks/site.yml"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(workspace, "playbooks", "callback_plugins", "deploji_events.py")); err != nil {
+		t.Errorf("expected plugin adjacent to the playbook: %s", err)
+	}
+	if err := InstallCallbackPlugin(workspace, "../site.yml"); err == nil {
+		t.Error("expected error installing plugin outside of the workspace")
+	}
+	if err := os.Symlink("/tmp", filepath.Join(workspace, "callback_plugins")); err != nil {
+		t.Fatal(err)
+	}
+	if err := InstallCallbackPlugin(workspace, "site.yml"); err == nil {
+		t.Error("expected error installing plugin into a symlink")
+	}
+}
@@ -0,0 +1,56 @@
+package ansibleService
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+// HostResult counts tasks of a host by their result, as summarized by the playbook_on_stats event.
+type HostResult struct {
+	Host        string
+	Ok          int
+	Changed     int
+	Unreachable int
+	Failed      int
+	Skipped     int
+	Rescued     int
+	Ignored     int
+}
+
+// hostStats is the summary of a host computed by Ansible's AggregateStats.summarize.
+type hostStats struct {
+	Ok          int `json:"ok"`
+	Changed     int `json:"changed"`
+	Unreachable int `json:"unreachable"`
+	Failures    int `json:"failures"`
+	Skipped     int `json:"skipped"`
+	Rescued     int `json:"rescued"`
+	Ignored     int `json:"ignored"`
+}
+
+// HostResults decodes results of hosts of a playbook_on_stats event, ordered by host name.
+func (e *Event) HostResults() ([]HostResult, error) {
+	stats := make(map[string]hostStats)
+	if len(e.Stats) > 0 {
+		if err := json.Unmarshal(e.Stats, &stats); err != nil {
+			return nil, err
+		}
+	}
+	results := make([]HostResult, 0, len(stats))
+	for host, summary := range stats {
+		results = append(results, HostResult{
+			Host:        host,
+			Ok:          summary.Ok,
+			Changed:     summary.Changed,
+			Unreachable: summary.Unreachable,
+			Failed:      summary.Failures,
+			Skipped:     summary.Skipped,
+			Rescued:     summary.Rescued,
+			Ignored:     summary.Ignored,
+		})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Host < results[j].Host
+	})
+	return results, nil
+}
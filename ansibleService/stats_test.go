@@ -0,0 +1,32 @@
+package ansibleService
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEventHostResults(t *testing.T) {
+	event, err := ParseEvent([]byte(`{"event": "playbook_on_stats", "timestamp": "2020-10-01T12:00:02.000000Z", "stats": {` +
+		`"web1": {"ok": 2, "changed": 1, "unreachable": 0, "failures": 0, "skipped": 1, "rescued": 0, "ignored": 0}, ` +
+		`"db1": {"ok": 0, "changed": 0, "unreachable": 1, "failures": 0, "skipped": 0, "rescued": 0, "ignored": 0}, ` +
+		`"web2": {"ok": 1, "changed": 0, "unreachable": 0, "failures": 1, "skipped": 0, "rescued": 1, "ignored": 2}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts, err := event.HostResults()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []HostResult{
+		{Host: "db1", Unreachable: 1},
+		{Host: "web1", Ok: 2, Changed: 1, Skipped: 1},
+		{Host: "web2", Ok: 1, Failed: 1, Rescued: 1, Ignored: 2},
+	}
+	if !reflect.DeepEqual(hosts, expected) {
+		t.Errorf("expected %+v, got %+v", expected, hosts)
+	}
+
+	if hosts, err := (&Event{Event: EventStats}).HostResults(); err != nil || len(hosts) != 0 {
+		t.Errorf("expected no hosts, got %+v, %v", hosts, err)
+	}
+}
@@ -0,0 +1,96 @@
+package brokerService
+
+import (
+	"github.com/deploji/deploji-server/dto"
+	"golang.org/x/net/context"
+	"sync"
+	"time"
+)
+
+// Broker transports jobs to the worker and job statuses, logs, events and dead letters from it.
+type Broker interface {
+	// SubscribeJobs passes jobs from the queues to deliveries until ctx is cancelled or the subscription fails.
+	// Prefetch limits the number of deliveries of all the queues together which are not acknowledged yet.
+	SubscribeJobs(ctx context.Context, queueNames []string, prefetch int, deliveries chan<- *Delivery)
+	// SubscribeControl passes control messages published to all workers to messages.
+	SubscribeControl(ctx context.Context, messages chan<- dto.Message)
+	PublishStatus(message dto.Message)
+	PublishLog(jobID uint, message dto.Message)
+	// PublishEvent publishes a structured Ansible event of the job, alongside its log.
+	PublishEvent(jobID uint, message dto.Message)
+	PublishDeadLetter(deadLetter DeadLetter)
+	PublishHeartbeat(message dto.Message)
+	// Close publishes pending messages, waiting at most timeout, and releases the broker.
+	Close(timeout time.Duration)
+}
+
+// DeadLetter is a message the application cannot process, together with the reason it was rejected.
+type DeadLetter struct {
+	Body       dto.Message
+	Reason     string
+	RoutingKey string
+	Headers    map[string]interface{}
+}
+
+// Acknowledger settles deliveries in the broker they were received from.
+type Acknowledger interface {
+	Ack(tag uint64, multiple bool) error
+	Nack(tag uint64, multiple bool, requeue bool) error
+}
+
+// Delivery is a consumed message together with the delivery tag it has to be acknowledged with.
+// The message stays unacknowledged until the application calls Ack or Nack.
+type Delivery struct {
+	Body         dto.Message
+	Headers      map[string]interface{}
+	RoutingKey   string
+	DeliveryTag  uint64
+	Redelivered  bool
+	acknowledger Acknowledger
+	mutex        sync.Mutex
+	acknowledged bool
+}
+
+func NewDelivery(body dto.Message, headers map[string]interface{}, routingKey string, deliveryTag uint64, redelivered bool, acknowledger Acknowledger) *Delivery {
+	return &Delivery{
+		Body:         body,
+		Headers:      headers,
+		RoutingKey:   routingKey,
+		DeliveryTag:  deliveryTag,
+		Redelivered:  redelivered,
+		acknowledger: acknowledger,
+	}
+}
+
+// Ack acknowledges the delivery, further calls to Ack or Nack are ignored.
+func (d *Delivery) Ack() error {
+	if !d.settle() {
+		return nil
+	}
+	return d.acknowledger.Ack(d.DeliveryTag, false)
+}
+
+// Nack rejects the delivery, further calls to Ack or Nack are ignored.
+func (d *Delivery) Nack(requeue bool) error {
+	if !d.settle() {
+		return nil
+	}
+	return d.acknowledger.Nack(d.DeliveryTag, false, requeue)
+}
+
+// Acknowledged reports whether the delivery was already acked or nacked.
+func (d *Delivery) Acknowledged() bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.acknowledged
+}
+
+func (d *Delivery) settle() bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.acknowledged {
+		return false
+	}
+	d.acknowledged = true
+	return true
+}
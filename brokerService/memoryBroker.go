@@ -0,0 +1,287 @@
+package brokerService
+
+import (
+	"fmt"
+	"github.com/deploji/deploji-server/dto"
+	"golang.org/x/net/context"
+	"sync"
+	"time"
+)
+
+var _ Broker = &MemoryBroker{}
+
+// MemoryBroker keeps all messages in memory. It is used in tests and in single node runs,
+// where jobs are submitted with Enqueue instead of being received from a message broker.
+// Published messages are discarded unless Record is called.
+type MemoryBroker struct {
+	mutex       sync.Mutex
+	record      bool
+	changed     chan struct{}
+	nextTag     uint64
+	queues      map[string]*memoryQueue
+	controls    []*memoryControlSubscriber
+	statuses    []dto.Message
+	logs        map[uint][]dto.Message
+	events      map[uint][]dto.Message
+	deadLetters []DeadLetter
+	heartbeats  []dto.Message
+}
+
+type memoryMessage struct {
+	body        dto.Message
+	redelivered bool
+}
+
+type memoryQueue struct {
+	ready   []memoryMessage
+	unacked map[uint64]memoryMessage
+}
+
+type memoryControlSubscriber struct {
+	ctx      context.Context
+	messages chan<- dto.Message
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{
+		changed: make(chan struct{}),
+		queues:  make(map[string]*memoryQueue),
+		logs:    make(map[uint][]dto.Message),
+		events:  make(map[uint][]dto.Message),
+	}
+}
+
+// Record keeps published messages, so they can be inspected, e.g. by tests. The history is not limited,
+// so it should not be recorded by long running workers.
+func (b *MemoryBroker) Record() *MemoryBroker {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.record = true
+	return b
+}
+
+// Enqueue adds a job message to the queue.
+func (b *MemoryBroker) Enqueue(queueName string, body dto.Message) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	queue := b.queue(queueName)
+	queue.ready = append(queue.ready, memoryMessage{body: body})
+	b.notify()
+}
+
+// Pending returns the number of messages in the queue which are not acknowledged yet.
+func (b *MemoryBroker) Pending(queueName string) int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	queue := b.queue(queueName)
+	return len(queue.ready) + len(queue.unacked)
+}
+
+func (b *MemoryBroker) SubscribeJobs(ctx context.Context, queueNames []string, prefetch int, deliveries chan<- *Delivery) {
+	for {
+		delivery, changed := b.next(queueNames, prefetch)
+		if delivery == nil {
+			select {
+			case <-changed:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+		select {
+		case deliveries <- delivery:
+		case <-ctx.Done():
+			delivery.Nack(true)
+			return
+		}
+	}
+}
+
+// next returns the next delivery of the first queue having one, or nil and a channel closed on the next change
+// of the broker when the queues are empty or the prefetch limit of the queues is reached.
+func (b *MemoryBroker) next(queueNames []string, prefetch int) (*Delivery, <-chan struct{}) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	unacked := 0
+	for _, queueName := range queueNames {
+		unacked += len(b.queue(queueName).unacked)
+	}
+	if prefetch > 0 && unacked >= prefetch {
+		return nil, b.changed
+	}
+	for _, queueName := range queueNames {
+		queue := b.queue(queueName)
+		if len(queue.ready) == 0 {
+			continue
+		}
+		message := queue.ready[0]
+		queue.ready = queue.ready[1:]
+		b.nextTag++
+		queue.unacked[b.nextTag] = message
+		return NewDelivery(message.body, nil, queueName, b.nextTag, message.redelivered, &memoryAcknowledger{b, queueName}), nil
+	}
+	return nil, b.changed
+}
+
+func (b *MemoryBroker) SubscribeControl(ctx context.Context, messages chan<- dto.Message) {
+	subscriber := &memoryControlSubscriber{ctx: ctx, messages: messages}
+	b.mutex.Lock()
+	b.controls = append(b.controls, subscriber)
+	b.mutex.Unlock()
+
+	<-ctx.Done()
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for i, s := range b.controls {
+		if s == subscriber {
+			b.controls = append(b.controls[:i], b.controls[i+1:]...)
+			break
+		}
+	}
+}
+
+// PublishControl passes the control message to all control subscribers.
+func (b *MemoryBroker) PublishControl(message dto.Message) {
+	b.mutex.Lock()
+	subscribers := make([]*memoryControlSubscriber, len(b.controls))
+	copy(subscribers, b.controls)
+	b.mutex.Unlock()
+
+	for _, subscriber := range subscribers {
+		select {
+		case subscriber.messages <- message:
+		case <-subscriber.ctx.Done():
+		}
+	}
+}
+
+func (b *MemoryBroker) PublishStatus(message dto.Message) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if !b.record {
+		return
+	}
+	b.statuses = append(b.statuses, message)
+}
+
+func (b *MemoryBroker) PublishLog(jobID uint, message dto.Message) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if !b.record {
+		return
+	}
+	b.logs[jobID] = append(b.logs[jobID], message)
+}
+
+func (b *MemoryBroker) PublishEvent(jobID uint, message dto.Message) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if !b.record {
+		return
+	}
+	b.events[jobID] = append(b.events[jobID], message)
+}
+
+func (b *MemoryBroker) PublishDeadLetter(deadLetter DeadLetter) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if !b.record {
+		return
+	}
+	b.deadLetters = append(b.deadLetters, deadLetter)
+}
+
+func (b *MemoryBroker) PublishHeartbeat(message dto.Message) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if !b.record {
+		return
+	}
+	b.heartbeats = append(b.heartbeats, message)
+}
+
+// Statuses returns all published job statuses.
+func (b *MemoryBroker) Statuses() []dto.Message {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return append([]dto.Message(nil), b.statuses...)
+}
+
+// Logs returns all published logs of the job.
+func (b *MemoryBroker) Logs(jobID uint) []dto.Message {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return append([]dto.Message(nil), b.logs[jobID]...)
+}
+
+// Events returns published events of the job.
+func (b *MemoryBroker) Events(jobID uint) []dto.Message {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return append([]dto.Message(nil), b.events[jobID]...)
+}
+
+// DeadLetters returns all published dead letters.
+func (b *MemoryBroker) DeadLetters() []DeadLetter {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return append([]DeadLetter(nil), b.deadLetters...)
+}
+
+// Heartbeats returns all published worker heartbeats.
+func (b *MemoryBroker) Heartbeats() []dto.Message {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return append([]dto.Message(nil), b.heartbeats...)
+}
+
+// Close is a no-op, published messages are kept in memory.
+func (b *MemoryBroker) Close(timeout time.Duration) {
+}
+
+func (b *MemoryBroker) queue(queueName string) *memoryQueue {
+	queue, ok := b.queues[queueName]
+	if !ok {
+		queue = &memoryQueue{unacked: make(map[uint64]memoryMessage)}
+		b.queues[queueName] = queue
+	}
+	return queue
+}
+
+// notify wakes up subscribers waiting for a change, it must be called with the mutex locked.
+func (b *MemoryBroker) notify() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// memoryAcknowledger settles deliveries of a MemoryBroker queue.
+type memoryAcknowledger struct {
+	broker    *MemoryBroker
+	queueName string
+}
+
+func (a *memoryAcknowledger) Ack(tag uint64, multiple bool) error {
+	return a.settle(tag, false)
+}
+
+func (a *memoryAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	return a.settle(tag, requeue)
+}
+
+func (a *memoryAcknowledger) settle(tag uint64, requeue bool) error {
+	a.broker.mutex.Lock()
+	defer a.broker.mutex.Unlock()
+	queue := a.broker.queue(a.queueName)
+	message, ok := queue.unacked[tag]
+	if !ok {
+		return fmt.Errorf("unknown delivery tag %d", tag)
+	}
+	delete(queue.unacked, tag)
+	if requeue {
+		message.redelivered = true
+		queue.ready = append([]memoryMessage{message}, queue.ready...)
+	}
+	a.broker.notify()
+	return nil
+}
@@ -0,0 +1,162 @@
+package brokerService
+
+import (
+	"github.com/deploji/deploji-server/dto"
+	"golang.org/x/net/context"
+	"testing"
+	"time"
+)
+
+func receive(t *testing.T, deliveries <-chan *Delivery) *Delivery {
+	select {
+	case delivery := <-deliveries:
+		return delivery
+	case <-time.After(time.Second):
+		t.Fatal("expected delivery, got none")
+		return nil
+	}
+}
+
+func expectNone(t *testing.T, deliveries <-chan *Delivery) {
+	select {
+	case delivery := <-deliveries:
+		t.Fatalf("expected no delivery, got %s", delivery.Body)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestMemoryBrokerPrefetch(t *testing.T) {
+	broker := NewMemoryBroker()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	deliveries := make(chan *Delivery)
+	go broker.SubscribeJobs(ctx, []string{"jobs"}, 1, deliveries)
+
+	broker.Enqueue("jobs", dto.Message("first"))
+	broker.Enqueue("jobs", dto.Message("second"))
+
+	first := receive(t, deliveries)
+	if string(first.Body) != "first" {
+		t.Errorf("expected first, actual %s", first.Body)
+	}
+	expectNone(t, deliveries)
+
+	if err := first.Ack(); err != nil {
+		t.Fatalf("Ack: %s", err)
+	}
+	second := receive(t, deliveries)
+	if string(second.Body) != "second" {
+		t.Errorf("expected second, actual %s", second.Body)
+	}
+	second.Ack()
+	if pending := broker.Pending("jobs"); pending != 0 {
+		t.Errorf("expected no pending messages, actual %d", pending)
+	}
+}
+
+func TestMemoryBrokerSharedPrefetch(t *testing.T) {
+	broker := NewMemoryBroker()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	deliveries := make(chan *Delivery)
+	go broker.SubscribeJobs(ctx, []string{"jobs", "jobs.gpu"}, 1, deliveries)
+
+	broker.Enqueue("jobs.gpu", dto.Message("gpu"))
+	broker.Enqueue("jobs", dto.Message("default"))
+
+	first := receive(t, deliveries)
+	expectNone(t, deliveries)
+	first.Ack()
+	second := receive(t, deliveries)
+	if first.RoutingKey == second.RoutingKey {
+		t.Errorf("expected deliveries of both queues, got %s twice", first.RoutingKey)
+	}
+	second.Ack()
+}
+
+func TestMemoryBrokerRequeue(t *testing.T) {
+	broker := NewMemoryBroker()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	deliveries := make(chan *Delivery)
+	go broker.SubscribeJobs(ctx, []string{"jobs"}, 1, deliveries)
+
+	broker.Enqueue("jobs", dto.Message("job"))
+	delivery := receive(t, deliveries)
+	if delivery.Redelivered {
+		t.Error("expected first delivery not to be redelivered")
+	}
+	if err := delivery.Nack(true); err != nil {
+		t.Fatalf("Nack: %s", err)
+	}
+	if err := delivery.Ack(); err != nil {
+		t.Errorf("expected Ack of settled delivery to be ignored, got %s", err)
+	}
+
+	redelivery := receive(t, deliveries)
+	if !redelivery.Redelivered {
+		t.Error("expected requeued delivery to be redelivered")
+	}
+	if string(redelivery.Body) != "job" {
+		t.Errorf("expected job, actual %s", redelivery.Body)
+	}
+}
+
+func TestMemoryBrokerControl(t *testing.T) {
+	broker := NewMemoryBroker()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	first := make(chan dto.Message, 1)
+	second := make(chan dto.Message, 1)
+	go broker.SubscribeControl(ctx, first)
+	go broker.SubscribeControl(ctx, second)
+	for {
+		broker.mutex.Lock()
+		subscribed := len(broker.controls)
+		broker.mutex.Unlock()
+		if subscribed == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	broker.PublishControl(dto.Message("cancel"))
+	for _, messages := range []chan dto.Message{first, second} {
+		if message := <-messages; string(message) != "cancel" {
+			t.Errorf("expected cancel, actual %s", message)
+		}
+	}
+}
+
+func TestMemoryBrokerPublish(t *testing.T) {
+	broker := NewMemoryBroker().Record()
+	broker.PublishStatus(dto.Message("status"))
+	broker.PublishLog(1, dto.Message("first"))
+	broker.PublishLog(1, dto.Message("second"))
+	broker.PublishLog(2, dto.Message("other"))
+	broker.PublishDeadLetter(DeadLetter{Body: dto.Message("invalid"), Reason: "reason"})
+
+	if statuses := broker.Statuses(); len(statuses) != 1 || string(statuses[0]) != "status" {
+		t.Errorf("unexpected statuses: %q", statuses)
+	}
+	if logs := broker.Logs(1); len(logs) != 2 || string(logs[0]) != "first" || string(logs[1]) != "second" {
+		t.Errorf("unexpected logs: %q", logs)
+	}
+	if deadLetters := broker.DeadLetters(); len(deadLetters) != 1 || deadLetters[0].Reason != "reason" {
+		t.Errorf("unexpected dead letters: %v", deadLetters)
+	}
+}
+
+func TestMemoryBrokerDiscardsPublishedMessages(t *testing.T) {
+	broker := NewMemoryBroker()
+	broker.PublishStatus(dto.Message("status"))
+	broker.PublishLog(1, dto.Message("log"))
+	broker.PublishEvent(1, dto.Message("event"))
+	broker.PublishDeadLetter(DeadLetter{Body: dto.Message("invalid")})
+	broker.PublishHeartbeat(dto.Message("heartbeat"))
+
+	if len(broker.Statuses()) != 0 || len(broker.Logs(1)) != 0 || len(broker.Events(1)) != 0 ||
+		len(broker.DeadLetters()) != 0 || len(broker.Heartbeats()) != 0 {
+		t.Error("expected published messages not to be kept without Record")
+	}
+}
@@ -1,5 +1,7 @@
 #!/usr/bin/env bash
 mkdir -p bin
-GOOS=windows GOARCH=amd64 go build  -ldflags="-w -s" -o bin/deploji-worker-Windows-x86_64.exe
-GOOS=linux GOARCH=amd64 go build  -ldflags="-w -s" -o bin/deploji-worker-Linux-x86_64
-GOOS=darwin GOARCH=amd64 go build  -ldflags="-w -s" -o bin/deploji-worker-Darwin-x86_64
+VERSION=$(git describe --tags --always)
+LDFLAGS="-w -s -X github.com/deploji/deploji-worker/workerService.Version=${VERSION}"
+GOOS=windows GOARCH=amd64 go build  -ldflags="${LDFLAGS}" -o bin/deploji-worker-Windows-x86_64.exe
+GOOS=linux GOARCH=amd64 go build  -ldflags="${LDFLAGS}" -o bin/deploji-worker-Linux-x86_64
+GOOS=darwin GOARCH=amd64 go build  -ldflags="${LDFLAGS}" -o bin/deploji-worker-Darwin-x86_64
@@ -6,6 +6,7 @@ require (
 	cloud.google.com/go v0.44.3 // indirect
 	github.com/SherClockHolmes/webpush-go v1.1.2
 	github.com/deploji/deploji-server v0.0.0-20201013235003-4e8a194e4fce
+	github.com/jinzhu/gorm v1.9.10
 	github.com/joho/godotenv v1.3.0
 	github.com/sirupsen/logrus v1.4.2
 	github.com/streadway/amqp v1.0.0
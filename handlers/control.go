@@ -0,0 +1,38 @@
+package handlers
+
+import (
+	"encoding/json"
+	"github.com/deploji/deploji-server/dto"
+	"github.com/deploji/deploji-worker/workerService"
+	"log"
+)
+
+type ControlCommand string
+
+const (
+	ControlCommandCancel ControlCommand = "cancel"
+)
+
+// ControlMessage is a command published to all workers through the control exchange.
+type ControlMessage struct {
+	Command ControlCommand
+	JobID   uint
+}
+
+// ProcessControlMessage executes the command if it addresses a job running in the pool.
+func ProcessControlMessage(message dto.Message, pool *workerService.Pool) {
+	control := &ControlMessage{}
+	if err := json.Unmarshal(message, control); err != nil {
+		log.Printf("Error decoding control message: %s", err)
+		return
+	}
+
+	switch control.Command {
+	case ControlCommandCancel:
+		if pool.Cancel(control.JobID) {
+			log.Printf("Cancelling job %d", control.JobID)
+		}
+	default:
+		log.Printf("Unsupported control command: %s", control.Command)
+	}
+}
@@ -0,0 +1,127 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/deploji/deploji-server/dto"
+	"github.com/deploji/deploji-server/models"
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// ExecutionEnvironment is a Python virtualenv with a pinned ansible-core version, declared by the project of a job.
+// Environments are built once per worker and reused by all jobs declaring the same environment.
+type ExecutionEnvironment struct {
+	Name string
+	// AnsibleVersion is the ansible-core version installed in the environment.
+	AnsibleVersion string
+	// Requirements are additional pip requirement specifiers, e.g. "boto3==1.28.0".
+	Requirements []string
+}
+
+// environmentsDir is the directory of built execution environments.
+const environmentsDir = "storage/environments"
+
+// environmentCompleteFile marks environments which were built successfully. Virtualenvs cannot be moved
+// once created, so they are built in place and environments without the marker are rebuilt.
+const environmentCompleteFile = ".deploji-complete"
+
+var (
+	environmentNamePattern = regexp.MustCompile(`^[\w.\-]+$`)
+	ansibleVersionPattern  = regexp.MustCompile(`^\d+(\.\d+){0,2}([a-z]+\d*)?$`)
+	pipRequirementPattern  = regexp.MustCompile(`^[A-Za-z0-9][\w.\-]*(\[[\w.,\-]+\])?([=<>!~]=?[\w.*+\-]+(,[=<>!~]=?[\w.*+\-]+)*)?$`)
+)
+
+var environmentLocks = newKeyedLocks()
+
+// lockEnvironment serializes building of an environment between concurrently running jobs.
+func lockEnvironment(dir string) func() {
+	return environmentLocks.lock(dir)
+}
+
+// validate checks the environment can be built. Requirements are limited to package specifiers,
+// so pip options like --index-url or -r cannot be passed.
+func (e *ExecutionEnvironment) validate() error {
+	if !environmentNamePattern.MatchString(e.Name) {
+		return fmt.Errorf("invalid execution environment name: %q", e.Name)
+	}
+	if !ansibleVersionPattern.MatchString(e.AnsibleVersion) {
+		return fmt.Errorf("invalid ansible-core version: %q", e.AnsibleVersion)
+	}
+	for _, requirement := range e.Requirements {
+		if !pipRequirementPattern.MatchString(requirement) {
+			return fmt.Errorf("invalid pip requirement: %q", requirement)
+		}
+	}
+	return nil
+}
+
+// dir returns the directory of the environment. It is keyed by the name and a hash of installed packages,
+// so changing the ansible-core version or requirements builds a new environment.
+func (e *ExecutionEnvironment) dir() string {
+	hash := sha256.Sum256([]byte(strings.Join(e.packages(), "\n")))
+	return filepath.Join(environmentsDir, fmt.Sprintf("%s-%s", e.Name, hex.EncodeToString(hash[:])[:12]))
+}
+
+func (e *ExecutionEnvironment) packages() []string {
+	return append([]string{fmt.Sprintf("ansible-core==%s", e.AnsibleVersion)}, e.Requirements...)
+}
+
+// prepareEnvironment builds the execution environment of the job unless it is built already.
+// It returns the absolute path of the bin directory of the environment, or an empty string for jobs
+// using the ansible installed on the worker.
+func prepareEnvironment(ctx context.Context, environment *ExecutionEnvironment, job *models.Job, jobLogs chan dto.Message) (string, error) {
+	if environment == nil {
+		return "", nil
+	}
+	dir, err := filepath.Abs(environment.dir())
+	if err != nil {
+		return "", err
+	}
+	defer lockEnvironment(dir)()
+	binDir := filepath.Join(dir, "bin")
+	if _, err := os.Stat(filepath.Join(dir, environmentCompleteFile)); err == nil {
+		saveJobLog(jobLogs, job, fmt.Sprintf("Using execution environment %s with ansible-core %s", environment.Name, environment.AnsibleVersion))
+		return binDir, nil
+	}
+
+	saveJobLog(jobLogs, job, fmt.Sprintf("Building execution environment %s with ansible-core %s", environment.Name, environment.AnsibleVersion))
+	if err := os.RemoveAll(dir); err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(environmentsDir, 0755); err != nil {
+		return "", err
+	}
+	python := os.Getenv("VIRTUALENV_PYTHON")
+	if python == "" {
+		python = "python3"
+	}
+	if err := runEnvironmentCommand(ctx, job, jobLogs, exec.Command(python, "-m", "venv", dir)); err != nil {
+		return "", err
+	}
+	args := append([]string{"install", "--disable-pip-version-check", "--no-input"}, environment.packages()...)
+	if err := runEnvironmentCommand(ctx, job, jobLogs, exec.Command(filepath.Join(binDir, "pip"), args...)); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, environmentCompleteFile), nil, 0644); err != nil {
+		return "", err
+	}
+	return binDir, nil
+}
+
+func runEnvironmentCommand(ctx context.Context, job *models.Job, jobLogs chan dto.Message, cmd *exec.Cmd) error {
+	cmd.Env = append([]string(nil), playbookEnv...)
+	saveJobLog(jobLogs, job, strings.Join(cmd.Args, " "))
+	setProcessGroup(cmd)
+	pipes := processPipes(cmd, jobLogs, job)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	return waitCommand(ctx, cmd, pipes)
+}
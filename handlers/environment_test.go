@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"github.com/deploji/deploji-server/models"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExecutionEnvironmentValidate(t *testing.T) {
+	valid := ExecutionEnvironment{Name: "aws", AnsibleVersion: "2.15.4", Requirements: []string{"boto3==1.28.0", "botocore>=1.31,<2", "requests[socks]"}}
+	if err := valid.validate(); err != nil {
+		t.Error(err)
+	}
+	invalid := []ExecutionEnvironment{
+		{Name: "../aws", AnsibleVersion: "2.15.4"},
+		{Name: "aws", AnsibleVersion: "latest"},
+		{Name: "aws", AnsibleVersion: "2.15.4", Requirements: []string{"--index-url=http://example.com"}},
+		{Name: "aws", AnsibleVersion: "2.15.4", Requirements: []string{"-r /etc/passwd"}},
+	}
+	for _, environment := range invalid {
+		if err := environment.validate(); err == nil {
+			t.Errorf("expected %+v to be invalid", environment)
+		}
+	}
+}
+
+func TestExecutionEnvironmentDir(t *testing.T) {
+	environment := ExecutionEnvironment{Name: "aws", AnsibleVersion: "2.15.4"}
+	upgraded := ExecutionEnvironment{Name: "aws", AnsibleVersion: "2.16.0"}
+	if !strings.HasPrefix(environment.dir(), "storage/environments/aws-") {
+		t.Errorf("unexpected dir %s", environment.dir())
+	}
+	if environment.dir() == upgraded.dir() {
+		t.Error("environments with different ansible-core versions should not share a dir")
+	}
+}
+
+func TestNewPlaybookCommandEnvironment(t *testing.T) {
+	job := &models.Job{Type: models.TypeJob, Inventory: models.Inventory{SourceFile: "hosts"}, Playbook: "site.yml"}
+	command := newPlaybookCommand(playbookSpec{Job: job, ExtraVarsFile: "/tmp/extraVars", BinDir: "/envs/aws/bin"})
+	if command.Args[0] != "/envs/aws/bin/ansible-playbook" {
+		t.Errorf("expected ansible-playbook of the environment, got %s", command.Args[0])
+	}
+	expected := []string{
+		"ANSIBLE_FORCE_COLOR=true",
+		"ANSIBLE_HOST_KEY_CHECKING=False",
+		"PATH=/envs/aws/bin:/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
+		"VIRTUAL_ENV=/envs/aws",
+	}
+	if !reflect.DeepEqual(command.Env, expected) {
+		t.Errorf("expected %v, got %v", expected, command.Env)
+	}
+}
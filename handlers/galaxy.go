@@ -0,0 +1,153 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/deploji/deploji-server/dto"
+	"github.com/deploji/deploji-server/models"
+	"github.com/deploji/deploji-worker/ansibleService"
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// galaxyRequirement is a requirements file of a project installed by ansible-galaxy before playbook runs.
+type galaxyRequirement struct {
+	// Kind is roles or collections, it is the ansible-galaxy subcommand.
+	Kind string
+	// File is the path of the requirements file relative to the workspace.
+	File string
+	// PathVariable points ansible-playbook at installed requirements.
+	PathVariable string
+	// ConfigSettings are names of the setting of PathVariable in ansible-config dump, it was renamed by ansible-core.
+	ConfigSettings []string
+}
+
+var galaxyRequirements = []galaxyRequirement{
+	{Kind: "roles", File: "roles/requirements.yml", PathVariable: "ANSIBLE_ROLES_PATH", ConfigSettings: []string{"DEFAULT_ROLES_PATH"}},
+	{Kind: "collections", File: "collections/requirements.yml", PathVariable: "ANSIBLE_COLLECTIONS_PATHS", ConfigSettings: []string{"COLLECTIONS_PATHS", "COLLECTIONS_PATH"}},
+}
+
+// galaxyCacheDir is the directory of installed requirements, they are kept per project, execution environment
+// and requirements file hash.
+const galaxyCacheDir = "storage/galaxy"
+
+// galaxyEnvironment returns the name of the cache of requirements installed by the execution environment,
+// collections installed by one ansible-core version are not necessarily usable by another one.
+func galaxyEnvironment(binDir string) string {
+	if binDir == "" {
+		return "system"
+	}
+	return filepath.Base(filepath.Dir(binDir))
+}
+
+// installGalaxyRequirements installs requirements files found in the workspace, unless requirements
+// with the same content are installed already. It returns environment variables pointing at installed requirements.
+func installGalaxyRequirements(ctx context.Context, job *models.Job, jobLogs chan dto.Message, workspace string, binDir string) ([]string, error) {
+	projectID := jobProjectID(job)
+	var env []string
+	var config ansibleService.ConfigDump
+	for _, requirement := range galaxyRequirements {
+		file := filepath.Join(workspace, requirement.File)
+		content, err := ioutil.ReadFile(file)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		hash := sha256.Sum256(content)
+		dir, err := filepath.Abs(filepath.Join(galaxyCacheDir, fmt.Sprintf("%d", projectID), galaxyEnvironment(binDir), requirement.Kind, hex.EncodeToString(hash[:])))
+		if err != nil {
+			return nil, err
+		}
+		if err := ensureGalaxyRequirement(ctx, job, jobLogs, binDir, requirement, file, dir); err != nil {
+			return nil, err
+		}
+		if config == nil {
+			if config, err = ansibleConfig(ctx, workspace, binDir); err != nil {
+				return nil, fmt.Errorf("cannot read Ansible configuration: %s", err)
+			}
+		}
+		env = append(env, galaxyPathEnv(requirement, dir, config))
+	}
+	return env, nil
+}
+
+// galaxyPathEnv returns the variable pointing ansible-playbook at installed requirements. The variable overrides
+// the configuration of the project, so the installation directory is prepended to the configured paths
+// and roles or collections vendored elsewhere in the repository still resolve.
+func galaxyPathEnv(requirement galaxyRequirement, dir string, config ansibleService.ConfigDump) string {
+	paths := []string{dir}
+	for _, setting := range requirement.ConfigSettings {
+		if configured, ok := config.Paths(setting); ok {
+			paths = append(paths, configured...)
+			break
+		}
+	}
+	return fmt.Sprintf("%s=%s", requirement.PathVariable, strings.Join(paths, string(os.PathListSeparator)))
+}
+
+// ansibleConfig returns the effective Ansible configuration of playbooks run in the workspace.
+func ansibleConfig(ctx context.Context, workspace string, binDir string) (ansibleService.ConfigDump, error) {
+	cmd := exec.CommandContext(ctx, ansibleExecutable(binDir, "ansible-config"), "dump")
+	cmd.Env = append(playbookEnvironment(binDir), "ANSIBLE_FORCE_COLOR=false", "ANSIBLE_NOCOLOR=true")
+	cmd.Dir = workspace
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+	return ansibleService.ParseConfigDump(string(output)), nil
+}
+
+var galaxyLocks = newKeyedLocks()
+
+// ensureGalaxyRequirement installs the requirements file into dir unless it is installed already. Installations
+// of the same requirements are serialized, jobs installing other requirements of the project are not blocked.
+func ensureGalaxyRequirement(ctx context.Context, job *models.Job, jobLogs chan dto.Message, binDir string, requirement galaxyRequirement, file string, dir string) error {
+	defer galaxyLocks.lock(dir)()
+	if _, err := os.Stat(dir); err == nil {
+		saveJobLog(jobLogs, job, fmt.Sprintf("Using %s installed from %s", requirement.Kind, requirement.File))
+		return nil
+	}
+	return installGalaxyRequirement(ctx, job, jobLogs, binDir, requirement, file, dir)
+}
+
+// installGalaxyRequirement installs the requirements file into a temporary directory, which is renamed to dir
+// once the installation succeeds, so interrupted installations are never used.
+func installGalaxyRequirement(ctx context.Context, job *models.Job, jobLogs chan dto.Message, binDir string, requirement galaxyRequirement, file string, dir string) error {
+	if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+		return err
+	}
+	tmpDir, err := ioutil.TempDir(filepath.Dir(dir), "install")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+	file, err = filepath.Abs(file)
+	if err != nil {
+		return err
+	}
+
+	// Roles are installed by the plain install command, the role subcommand is not available before Ansible 2.9.
+	args := []string{"install", "-r", file, "-p", tmpDir}
+	if requirement.Kind == "collections" {
+		args = append([]string{"collection"}, args...)
+	}
+	cmd := exec.Command(ansibleExecutable(binDir, "ansible-galaxy"), args...)
+	cmd.Env = playbookEnvironment(binDir)
+	saveJobLog(jobLogs, job, strings.Join(cmd.Args, " "))
+	setProcessGroup(cmd)
+	pipes := processPipes(cmd, jobLogs, job)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	if err := waitCommand(ctx, cmd, pipes); err != nil {
+		return err
+	}
+	return os.Rename(tmpDir, dir)
+}
@@ -0,0 +1,32 @@
+package handlers
+
+import (
+	"github.com/deploji/deploji-worker/ansibleService"
+	"testing"
+)
+
+func TestGalaxyPathEnv(t *testing.T) {
+	config := ansibleService.ConfigDump{
+		"DEFAULT_ROLES_PATH": "['/storage/workspaces/12/vendor/roles', '/etc/ansible/roles']",
+		"COLLECTIONS_PATH":   "['/usr/share/ansible/collections']",
+	}
+	roles, collections := galaxyRequirements[0], galaxyRequirements[1]
+	if env := galaxyPathEnv(roles, "/cache/roles", config); env != "ANSIBLE_ROLES_PATH=/cache/roles:/storage/workspaces/12/vendor/roles:/etc/ansible/roles" {
+		t.Errorf("unexpected roles path %s", env)
+	}
+	if env := galaxyPathEnv(collections, "/cache/collections", config); env != "ANSIBLE_COLLECTIONS_PATHS=/cache/collections:/usr/share/ansible/collections" {
+		t.Errorf("unexpected collections path %s", env)
+	}
+	if env := galaxyPathEnv(roles, "/cache/roles", ansibleService.ConfigDump{}); env != "ANSIBLE_ROLES_PATH=/cache/roles" {
+		t.Errorf("unexpected roles path without configuration %s", env)
+	}
+}
+
+func TestGalaxyEnvironment(t *testing.T) {
+	if environment := galaxyEnvironment(""); environment != "system" {
+		t.Errorf("expected system, got %s", environment)
+	}
+	if environment := galaxyEnvironment("/worker/storage/environments/ansible-2.15-0123456789ab/bin"); environment != "ansible-2.15-0123456789ab" {
+		t.Errorf("expected environment directory, got %s", environment)
+	}
+}
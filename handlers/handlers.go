@@ -6,51 +6,292 @@ import (
 	"fmt"
 	"github.com/deploji/deploji-server/dto"
 	"github.com/deploji/deploji-server/models"
-	"github.com/deploji/deploji-worker/amqpService"
+	"github.com/deploji/deploji-worker/ansibleService"
+	"github.com/deploji/deploji-worker/brokerService"
 	"github.com/deploji/deploji-worker/mailService"
 	"github.com/deploji/deploji-worker/templates"
 	"github.com/deploji/deploji-worker/utils"
 	"github.com/deploji/deploji-worker/webHookService"
 	"github.com/deploji/deploji-worker/webPushService"
+	"github.com/deploji/deploji-worker/workerModels"
+	"github.com/deploji/deploji-worker/workerService"
 	"github.com/sirupsen/logrus"
 	ssh2 "golang.org/x/crypto/ssh"
 	"golang.org/x/net/context"
 	"gopkg.in/src-d/go-git.v4"
 	"gopkg.in/src-d/go-git.v4/plumbing"
 	"gopkg.in/src-d/go-git.v4/plumbing/transport/ssh"
-	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
 	"strings"
+	"sync"
 	"time"
 )
 
-func ProcessJobMessage(message *dto.Message) {
-	job := &dto.JobMessage{}
-	if err := json.Unmarshal(*message, job); err != nil {
-		log.Printf("Error decoding JSON: %s", err)
+// Statuses set by the worker in addition to the ones defined by the server.
+const (
+	StatusInterrupted models.Status = 4
+	StatusCancelled   models.Status = 5
+	StatusTimedOut    models.Status = 6
+	// StatusPreviewed is set for successful preview runs. Previews do not apply changes, so they must not
+	// be taken for completed jobs, e.g. for the deployed version of an application.
+	StatusPreviewed models.Status = 7
+)
+
+// successful reports whether the job finished without errors.
+func successful(status models.Status) bool {
+	return status == models.StatusCompleted || status == StatusPreviewed
+}
+
+// previewStatus returns the final status of a run, successful preview runs finish as StatusPreviewed.
+func previewStatus(status models.Status, preview bool) models.Status {
+	if preview && status == models.StatusCompleted {
+		return StatusPreviewed
+	}
+	return status
+}
+
+var broker brokerService.Broker
+
+// SetBroker sets the broker used to publish job statuses, logs and dead letters.
+func SetBroker(b brokerService.Broker) {
+	broker = b
+}
+
+var projectLocks = newKeyedLocks()
+
+// lockProject serializes repository synchronization of a project between concurrently running jobs.
+func lockProject(projectID uint) func() {
+	return projectLocks.lock(fmt.Sprintf("%d", projectID))
+}
+
+// ProcessJobMessage runs the job and acknowledges the delivery once the job is finished.
+func ProcessJobMessage(delivery *brokerService.Delivery, slot *workerService.Slot) {
+	job := &JobMessage{}
+	if err := json.Unmarshal(delivery.Body, job); err != nil {
+		deadLetter(delivery, fmt.Sprintf("Error decoding JSON: %s", err))
+		return
+	}
+	if err := validateJobMessage(job); err != nil {
+		deadLetter(delivery, err.Error())
+		return
 	}
 
-	log.Printf("Processing job: {ID:%d, Type:%s}", job.ID, job.Type)
+	if !startRunning(job.ID) {
+		log.Printf("Job %d redelivered while still running on this worker, acknowledging the duplicate", job.ID)
+		ackDelivery(delivery)
+		return
+	}
+	defer stopRunning(job.ID)
+	getRun(job.ID).Preview = job.Preview
+	getRun(job.ID).Options = job.PlaybookOptions.String()
+
+	slot.SetJob(job.ID)
+	log.Printf("Processing job: {ID:%d, Type:%s} in slot %d", job.ID, job.Type, slot.ID)
 
-	ctx, done := context.WithCancel(context.Background())
 	jobLogs := make(chan dto.Message)
+	forwarded := make(chan struct{})
 	go func() {
-		amqpService.Publish(amqpService.Redial(ctx, os.Getenv("AMQP_URL")), jobLogs, fmt.Sprintf("job_log_%d", job.ID))
-		done()
+		forwardJobLogs(job.ID, jobLogs)
+		close(forwarded)
 	}()
+	ctx := slot.Context()
+	if timeout := job.timeout(); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	if !delivery.Redelivered || acceptRedelivery(ctx, job, jobLogs) {
+		if err := job.validateOptions(); err != nil {
+			failJob(job.ID, jobLogs, fmt.Sprintf("Invalid job options: %s", err))
+		} else {
+			switch job.Type {
+			case models.TypeJob, models.TypeDeployment:
+				processPlaybook(ctx, job, jobLogs)
+			case models.TypeSCMPull:
+				processSCMPull(ctx, job, jobLogs)
+			}
+		}
+	}
+	close(jobLogs)
+	<-forwarded
+	ackDelivery(delivery)
+}
+
+// forwardJobLogs passes logs of the job to the shared job log publisher.
+func forwardJobLogs(jobID uint, jobLogs <-chan dto.Message) {
+	for message := range jobLogs {
+		broker.PublishLog(jobID, message)
+	}
+}
+
+// LegacyJobLogExchanges returns names of per job log exchanges declared by previous versions of the worker.
+// Exchanges of all the jobs are listed, exchanges of jobs which are still running are kept by the removal.
+func LegacyJobLogExchanges() ([]string, error) {
+	var ids []uint
+	if err := models.GetDB().Model(&models.Job{}).Pluck("id", &ids).Error; err != nil {
+		return nil, err
+	}
+	names := make([]string, len(ids))
+	for i, id := range ids {
+		names[i] = fmt.Sprintf("job_log_%d", id)
+	}
+	return names, nil
+}
+
+// jobRun is the state of a job processed by this worker, reported in job status messages.
+type jobRun struct {
+	Attempt     int
+	MaxAttempts int
+	Failure     FailureClass
+	StartedAt   time.Time
+	FinishedAt  time.Time
+	// ExitCode of the last ansible-playbook run, nil when the command did not finish.
+	ExitCode *int
+	// Commit is the revision the project repository was reset to.
+	Commit string
+	Hosts  *HostSummary
+	// Preview is set for jobs run in check mode.
+	Preview bool
+	// Options describes playbook options of the job.
+	Options string
+}
+
+// runs holds jobs processed by this worker. When the broker connection is lost, unacknowledged
+// jobs are redelivered and may be received again while they are still running.
+var runs = struct {
+	sync.Mutex
+	jobs map[uint]*jobRun
+}{jobs: make(map[uint]*jobRun)}
+
+func startRunning(jobID uint) bool {
+	runs.Lock()
+	defer runs.Unlock()
+	if _, ok := runs.jobs[jobID]; ok {
+		return false
+	}
+	runs.jobs[jobID] = &jobRun{Attempt: 1, MaxAttempts: 1}
+	return true
+}
+
+func stopRunning(jobID uint) {
+	runs.Lock()
+	defer runs.Unlock()
+	delete(runs.jobs, jobID)
+}
+
+// getRun returns the state of the job, or nil when the job is not processed by this worker.
+func getRun(jobID uint) *jobRun {
+	runs.Lock()
+	defer runs.Unlock()
+	return runs.jobs[jobID]
+}
+
+// validateJobMessage checks the message can be processed by this worker.
+func validateJobMessage(job *JobMessage) error {
+	if job.ID == 0 {
+		return fmt.Errorf("Missing job ID")
+	}
+	if job.Label != "" && !workerService.Info().HasLabel(job.Label) {
+		return fmt.Errorf("Job targets label %s, worker labels: %s", job.Label, strings.Join(workerService.Info().Labels, ","))
+	}
+	if job.Retry != nil {
+		if err := job.Retry.validate(); err != nil {
+			return fmt.Errorf("Invalid retry policy: %s", err)
+		}
+	}
 	switch job.Type {
-	case models.TypeJob:
-		processJob(job.ID, jobLogs)
-	case models.TypeDeployment:
-		processDeployment(job.ID, jobLogs)
-	case models.TypeSCMPull:
-		processSCMPull(job.ID, jobLogs)
+	case models.TypeJob, models.TypeDeployment, models.TypeSCMPull:
+		return nil
 	default:
-		failJob(job.ID, jobLogs, fmt.Sprintf("Unsupported job type: %s", job.Type))
+		return fmt.Errorf("Unsupported job type: %s", job.Type)
+	}
+}
+
+// deadLetter routes a message the worker cannot process to the dead letter queue and acknowledges it.
+func deadLetter(delivery *brokerService.Delivery, reason string) {
+	log.Printf("Dead lettering delivery %d: %s", delivery.DeliveryTag, reason)
+	broker.PublishDeadLetter(brokerService.DeadLetter{
+		Body:       delivery.Body,
+		Reason:     reason,
+		RoutingKey: delivery.RoutingKey,
+		Headers:    delivery.Headers,
+	})
+	ackDelivery(delivery)
+}
+
+func ackDelivery(delivery *brokerService.Delivery) {
+	if err := delivery.Ack(); err != nil {
+		log.Printf("Cannot ack delivery %d: %s", delivery.DeliveryTag, err)
+	}
+}
+
+// acceptRedelivery decides whether a redelivered job should run. Only jobs which were never started are run again.
+// A job left in processing status is redelivered when the worker running it crashed or lost its broker connection.
+// Jobs still run by a live worker are left alone, jobs of crashed workers may have partially applied changes,
+// so they are failed instead of being silently repeated.
+func acceptRedelivery(ctx context.Context, message *JobMessage, jobLogs chan dto.Message) bool {
+	job := models.GetJob(message.ID)
+	if job == nil {
+		log.Printf("Job with ID: %d not found", message.ID)
+		return false
+	}
+	switch job.Status {
+	case models.StatusPending:
+		log.Printf("Job %d redelivered before it was started, processing", job.ID)
+		return true
+	case models.StatusProcessing:
+		owner, err := liveOwner(ctx, job.ID)
+		if err != nil {
+			log.Printf("Job %d redelivered in processing status, cannot check its worker, skipping: %s", job.ID, err)
+			return false
+		}
+		if owner != "" {
+			log.Printf("Job %d redelivered but still running on worker %s, skipping", job.ID, owner)
+			return false
+		}
+		failJob(job.ID, jobLogs, "Job was interrupted by a worker failure, it will not be restarted automatically")
+		return false
+	default:
+		log.Printf("Job %d redelivered but already finished with status %d, skipping", job.ID, job.Status)
+		return false
+	}
+}
+
+// liveOwner returns the ID of another live worker running the job, or an empty string when no live worker runs it.
+// Running jobs are recorded with heartbeats, so a job started shortly before it was redelivered is looked up
+// again after a heartbeat interval.
+func liveOwner(ctx context.Context, jobID uint) (string, error) {
+	interval := workerService.HeartbeatInterval()
+	for attempt := 0; ; attempt++ {
+		heartbeats, err := workerModels.GetWorkerHeartbeats(time.Now().Add(-heartbeatTimeout * interval))
+		if err != nil {
+			return "", err
+		}
+		if owner := findOwner(heartbeats, jobID, workerService.Info().ID); owner != "" || attempt > 0 {
+			return owner, nil
+		}
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
 	}
-	done()
+}
+
+// heartbeatTimeout is the number of heartbeat intervals after which a silent worker is considered dead.
+const heartbeatTimeout = 3
+
+// findOwner returns the worker reporting the job in its heartbeat. Heartbeats of this worker are skipped,
+// a job run by a previous process with the same worker ID is not run by the current one.
+func findOwner(heartbeats []*workerModels.WorkerHeartbeat, jobID uint, workerID string) string {
+	for _, heartbeat := range heartbeats {
+		if heartbeat.WorkerID != workerID && heartbeat.Runs(jobID) {
+			return heartbeat.WorkerID
+		}
+	}
+	return ""
 }
 
 func failJob(jobID uint, jobLogs chan dto.Message, message string) {
@@ -66,167 +307,144 @@ func failJob(jobID uint, jobLogs chan dto.Message, message string) {
 	}
 }
 
-func processSCMPull(jobID uint, jobLogs chan dto.Message) {
-	job := models.GetJob(jobID)
+func processSCMPull(ctx context.Context, message *JobMessage, jobLogs chan dto.Message) {
+	job := models.GetJob(message.ID)
 	sendNotification(job, templates.NotificationTypeStart, jobLogs)
 	if job == nil {
-		log.Printf("Job with ID: %d not found", jobID)
+		log.Printf("Job with ID: %d not found", message.ID)
 		return
 	}
 	if err := updateJobStatus(job, models.StatusProcessing); err != nil {
 		return
 	}
-	job.Status = models.StatusCompleted
-	if err := synchronizeProjectRepo(job, jobLogs); err != nil {
-		saveJobLog(jobLogs, job, fmt.Sprintf("Cannot synchronize project: %s", err))
-		job.Status = models.StatusFailed
-	}
+	job.Status = runWithRetries(ctx, job, jobLogs, message.retryPolicy(), func() FailureClass {
+		if err := synchronizeProjectRepo(ctx, job, jobLogs); err != nil {
+			saveJobLog(jobLogs, job, fmt.Sprintf("Cannot synchronize project: %s", err))
+			return FailureSCM
+		}
+		return ""
+	})
+	checkJobCancelled(ctx, job, jobLogs)
 	if err := updateJobStatus(job, job.Status); err != nil {
 		return
 	}
 
-	if job.Status == models.StatusCompleted {
-		sendNotification(job, templates.NotificationTypeSuccess, jobLogs)
-	} else {
-		sendNotification(job, templates.NotificationTypeFail, jobLogs)
-	}
+	sendFinishedNotification(job, jobLogs)
 }
 
-func processDeployment(jobID uint, jobLogs chan dto.Message) {
-	job := models.GetJob(jobID)
+// processPlaybook runs the playbook of a job or a deployment.
+func processPlaybook(ctx context.Context, message *JobMessage, jobLogs chan dto.Message) {
+	job := models.GetJob(message.ID)
 	sendNotification(job, templates.NotificationTypeStart, jobLogs)
 	if job == nil {
-		saveJobLog(jobLogs, job, fmt.Sprintf("Deployment with ID: %d not found", jobID))
+		saveJobLog(jobLogs, job, fmt.Sprintf("Job with ID: %d not found", message.ID))
 		return
 	}
 	if err := updateJobStatus(job, models.StatusProcessing); err != nil {
 		return
 	}
-	if err := synchronizeProjectRepo(job, jobLogs); err != nil {
-		saveJobLog(jobLogs, job, fmt.Sprintf("Cannot synchronize project: %s", err))
-	}
-	writeKeys(job, jobLogs)
-	extraVarsFile, err := ioutil.TempFile("/tmp/", "extraVars")
-	if err != nil {
-		saveJobLog(jobLogs, job, fmt.Sprintf("Cannot create temp file: %s", err))
-	}
-	defer os.Remove(extraVarsFile.Name())
-	job.ExtraVariables = fmt.Sprintf("%s\ndeploji_worker: true\n", job.ExtraVariables)
-	_, err = extraVarsFile.WriteString(job.ExtraVariables)
-	if err != nil {
-		saveJobLog(jobLogs, job, fmt.Sprintf("Cannot create temp file: %s", err))
-	}
-
-	keyPath := fmt.Sprintf("../../keys/%d", job.KeyID)
-	vaultKeyPath := fmt.Sprintf("../../keys/%d", job.VaultKeyID)
-	version := fmt.Sprintf("version=%s", job.Version)
-	app := fmt.Sprintf("app=%s", job.Application.AnsibleName)
-	saveJobLog(jobLogs, job, fmt.Sprintf("extra vars: \n%s", job.ExtraVariables))
-	cmd := exec.Command("ansible-playbook", "--private-key", keyPath, "-i", job.Inventory.SourceFile, "-e", app, "-e", version, "-e", "@"+extraVarsFile.Name(), job.Playbook)
-	if job.VaultKeyID != 0 {
-		cmd.Args = append(cmd.Args, "--vault-id", vaultKeyPath)
-	}
-	saveJobLog(jobLogs, job, strings.Join(cmd.Args, " "))
-	cmd.Dir = fmt.Sprintf("storage/repositories/%d", job.Inventory.ProjectID)
-	cmd.Env = []string{"ANSIBLE_FORCE_COLOR=true", "ANSIBLE_HOST_KEY_CHECKING=False", "PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"}
-	saveJobLog(jobLogs, job, fmt.Sprintf("cmd.Dir %s", cmd.Dir))
-	processPipes(cmd, jobLogs, job)
-
-	if err := cmd.Start(); err != nil {
-		saveJobLog(jobLogs, job, fmt.Sprintf("Cannot start command: %s", err))
-	}
-
-	job.Status = models.StatusCompleted
-	if err := cmd.Wait(); err != nil {
-		saveJobLog(jobLogs, job, fmt.Sprintf("Error waiting for process: %s", err))
-		job.Status = models.StatusFailed
-	}
+	job.Status = runWithRetries(ctx, job, jobLogs, message.retryPolicy(), func() FailureClass {
+		return runPlaybook(ctx, message, job, jobLogs)
+	})
+	job.Status = previewStatus(job.Status, message.Preview)
+	checkJobCancelled(ctx, job, jobLogs)
+	cleanupWorkspace(job, jobLogs)
 
 	if err := updateJobStatus(job, job.Status); err != nil {
 		log.Printf("Cannot update job status: %s", err)
 		return
 	}
+	sendFinishedNotification(job, jobLogs)
+}
 
-	if job.Status == models.StatusCompleted {
-		sendNotification(job, templates.NotificationTypeSuccess, jobLogs)
-	} else {
-		sendNotification(job, templates.NotificationTypeFail, jobLogs)
+// checkJobCancelled sets the status of a job whose context was cancelled before the job finished.
+func checkJobCancelled(ctx context.Context, job *models.Job, jobLogs chan dto.Message) {
+	switch workerService.CancelReason(ctx) {
+	case nil:
+	case workerService.ErrJobCancelled:
+		saveJobLog(jobLogs, job, "Job cancelled")
+		job.Status = StatusCancelled
+	case context.DeadlineExceeded:
+		deadline, _ := ctx.Deadline()
+		saveJobLog(jobLogs, job, fmt.Sprintf("Job timed out, execution deadline %s exceeded", deadline.Format(time.RFC3339)))
+		job.Status = StatusTimedOut
+	default:
+		saveJobLog(jobLogs, job, "Job interrupted by worker shutdown")
+		job.Status = StatusInterrupted
 	}
 }
 
-func processJob(jobID uint, jobLogs chan dto.Message) {
-	job := models.GetJob(jobID)
-	sendNotification(job, templates.NotificationTypeStart, jobLogs)
-	if job == nil {
-		saveJobLog(jobLogs, job, fmt.Sprintf("Deployment with ID: %d not found", jobID))
-		return
-	}
-	if err := updateJobStatus(job, models.StatusProcessing); err != nil {
+// recordExitCode stores the exit code of the finished command in the job run.
+func recordExitCode(job *models.Job, cmd *exec.Cmd) {
+	run := getRun(job.ID)
+	if run == nil || cmd.ProcessState == nil {
 		return
 	}
-	if err := synchronizeProjectRepo(job, jobLogs); err != nil {
-		saveJobLog(jobLogs, job, fmt.Sprintf("Cannot synchronize project: %s", err))
-	}
+	exitCode := cmd.ProcessState.ExitCode()
+	run.ExitCode = &exitCode
+}
 
-	writeKeys(job, jobLogs)
-	keyPath := fmt.Sprintf("../../keys/%d", job.KeyID)
-	vaultKeyPath := fmt.Sprintf("../../keys/%d", job.VaultKeyID)
-	extraVarsFile, err := ioutil.TempFile("/tmp/", "extraVars")
-	if err != nil {
-		saveJobLog(jobLogs, job, fmt.Sprintf("Cannot create temp file: %s", err))
-	}
-	defer os.Remove(extraVarsFile.Name())
-	job.ExtraVariables = fmt.Sprintf("%s\ndeploji_worker: true\n", job.ExtraVariables)
-	_, err = extraVarsFile.WriteString(job.ExtraVariables)
+// recordHostResults stores host results of the playbook_on_stats event and their summary in the job run.
+func recordHostResults(job *models.Job, event *ansibleService.Event) {
+	hosts, err := event.HostResults()
 	if err != nil {
-		saveJobLog(jobLogs, job, fmt.Sprintf("Cannot create temp file: %s", err))
-	}
-	saveJobLog(jobLogs, job, fmt.Sprintf("extra vars: \n%s", job.ExtraVariables))
-	cmd := exec.Command("ansible-playbook", "--private-key", keyPath, "-i", job.Inventory.SourceFile, "-e", "@"+extraVarsFile.Name(), job.Playbook)
-	if job.VaultKeyID != 0 {
-		cmd.Args = append(cmd.Args, "--vault-id", vaultKeyPath)
+		log.Printf("Cannot decode stats of job %d: %s", job.ID, err)
+		return
 	}
-
-	saveJobLog(jobLogs, job, fmt.Sprintf("ansible-playbook %s", strings.Join(cmd.Args, " ")))
-	//saveJobLog(jobLogs, job, fmt.Sprintf("ansible-playbook %s %s %s %s %s", "-i", job.Inventory.SourceFile, "-e", "@"+extraVarsFile.Name(), job.Playbook))
-	cmd.Dir = fmt.Sprintf("storage/repositories/%d", job.Inventory.ProjectID)
-	cmd.Env = []string{"ANSIBLE_FORCE_COLOR=true", "ANSIBLE_HOST_KEY_CHECKING=False", "PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"}
-	saveJobLog(jobLogs, job, fmt.Sprintf("cmd.Dir %s", cmd.Dir))
-	processPipes(cmd, jobLogs, job)
-
-	if err := cmd.Start(); err != nil {
-		saveJobLog(jobLogs, job, fmt.Sprintf("Cannot start command: %s", err))
+	results := make([]*workerModels.JobHostResult, len(hosts))
+	for i, host := range hosts {
+		results[i] = &workerModels.JobHostResult{
+			Host:        host.Host,
+			Ok:          host.Ok,
+			Changed:     host.Changed,
+			Unreachable: host.Unreachable,
+			Failed:      host.Failed,
+			Skipped:     host.Skipped,
+			Rescued:     host.Rescued,
+			Ignored:     host.Ignored,
+		}
 	}
-
-	job.Status = models.StatusCompleted
-	if err := cmd.Wait(); err != nil {
-		saveJobLog(jobLogs, job, fmt.Sprintf("Error waiting for process: %s", err))
-		job.Status = models.StatusFailed
+	workerModels.SaveJobHostResults(job.ID, results)
+	if run := getRun(job.ID); run != nil {
+		run.Hosts = newHostSummary(hosts)
 	}
+}
 
-	if err := updateJobStatus(job, job.Status); err != nil {
-		log.Printf("Cannot update job status: %s", err)
-		return
+// loadKeys adds the SSH key of the job and its additional machine credentials to the agent of the run.
+// Encrypted keys are unlocked with their passphrases.
+func loadKeys(job *models.Job, keyIDs []uint, sshAgent *sshAgent) error {
+	keys := make([]*models.SshKey, 0, len(keyIDs)+1)
+	if job.KeyID != 0 {
+		keys = append(keys, &job.Key)
+	}
+	for _, id := range keyIDs {
+		key := models.GetSshKey(id)
+		if key == nil {
+			return fmt.Errorf("key %d not found", id)
+		}
+		keys = append(keys, key)
 	}
-	if job.Status == models.StatusCompleted {
-		sendNotification(job, templates.NotificationTypeSuccess, jobLogs)
-	} else {
-		sendNotification(job, templates.NotificationTypeFail, jobLogs)
+	for _, key := range keys {
+		passphrase, err := workerModels.GetSshKeyPassphrase(key.ID)
+		if err != nil {
+			return fmt.Errorf("cannot get passphrase of key %s: %s", key.Title, err)
+		}
+		if err := sshAgent.add(key, passphrase); err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
-func writeKeys(job *models.Job, jobLogs chan dto.Message) {
-	if err := utils.WriteKey(job.Key.ID, string(job.Key.Key)); err != nil {
-		saveJobLog(jobLogs, job, fmt.Sprintf("Cannot write key: %s", err))
-	}
-	if job.VaultKeyID != 0 {
-		if err := utils.WriteKey(job.VaultKeyID, string(job.VaultKey.Key)); err != nil {
-			saveJobLog(jobLogs, job, fmt.Sprintf("Cannot write key: %s", err))
-		}
+// removeSecrets removes the secrets directory of the job.
+func removeSecrets(job *models.Job, secrets *utils.Secrets) {
+	if err := secrets.Remove(); err != nil {
+		log.Printf("Cannot remove secrets of job %d: %s", job.ID, err)
 	}
 }
 
-func processPipes(cmd *exec.Cmd, jobLogs chan dto.Message, job *models.Job) {
+// processPipes forwards command output to job logs. The returned WaitGroup is done when both pipes are drained.
+func processPipes(cmd *exec.Cmd, jobLogs chan dto.Message, job *models.Job) *sync.WaitGroup {
 	cmdOutReader, err := cmd.StdoutPipe()
 	if err != nil {
 		saveJobLog(jobLogs, job, fmt.Sprintf("Cannot get stdout pipe: %s", err))
@@ -240,17 +458,86 @@ func processPipes(cmd *exec.Cmd, jobLogs chan dto.Message, job *models.Job) {
 	outScanner := bufio.NewScanner(cmdOutReader)
 	errScanner := bufio.NewScanner(cmdErrReader)
 
+	var pipes sync.WaitGroup
+	pipes.Add(2)
 	go func() {
+		defer pipes.Done()
 		for outScanner.Scan() {
 			saveJobLog(jobLogs, job, outScanner.Text())
 		}
 	}()
 
 	go func() {
+		defer pipes.Done()
 		for errScanner.Scan() {
 			saveJobLog(jobLogs, job, errScanner.Text())
 		}
 	}()
+	return &pipes
+}
+
+// processEvents enables the event callback plugin for the command. Events it emits are stored and published
+// alongside the job log. The returned write end of the event pipe has to be closed once the command is started,
+// it is nil when the pipe cannot be created.
+func processEvents(cmd *exec.Cmd, jobLogs chan dto.Message, job *models.Job, pipes *sync.WaitGroup) *os.File {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		saveJobLog(jobLogs, job, fmt.Sprintf("Cannot create event pipe: %s", err))
+		return nil
+	}
+	if err := ansibleService.InstallCallbackPlugin(cmd.Dir, job.Playbook); err != nil {
+		saveJobLog(jobLogs, job, fmt.Sprintf("Cannot enable event callback plugin: %s", err))
+	}
+	cmd.ExtraFiles = append(cmd.ExtraFiles, writer)
+	cmd.Env = append(cmd.Env, ansibleService.EventsEnv(2+len(cmd.ExtraFiles))...)
+
+	pipes.Add(1)
+	go func() {
+		defer pipes.Done()
+		defer reader.Close()
+		ansibleService.ReadEvents(reader, func(event *ansibleService.Event) {
+			event.JobID = job.ID
+			switch event.Event {
+			case ansibleService.EventFileDiff:
+				saveJobDiffs(job, event)
+			case ansibleService.EventStats:
+				recordHostResults(job, event)
+			}
+			message := dto.MarshallMessage(event)
+			workerModels.SaveJobEvent(&workerModels.JobEvent{
+				JobID:     job.ID,
+				Event:     string(event.Event),
+				Timestamp: event.Timestamp,
+				Play:      event.Play,
+				Task:      event.Task,
+				Host:      event.Host,
+				Changed:   event.Changed,
+				Data:      string(message),
+			})
+			broker.PublishEvent(job.ID, message)
+		})
+	}()
+	return writer
+}
+
+func saveJobDiffs(job *models.Job, event *ansibleService.Event) {
+	diffs, err := event.Diffs()
+	if err != nil {
+		log.Printf("Cannot decode diff of job %d: %s", job.ID, err)
+		return
+	}
+	for _, diff := range diffs {
+		workerModels.SaveJobDiff(&workerModels.JobDiff{
+			JobID:        job.ID,
+			Task:         event.Task,
+			Host:         event.Host,
+			BeforeHeader: diff.BeforeHeader,
+			AfterHeader:  diff.AfterHeader,
+			Before:       diff.Before,
+			After:        diff.After,
+			Prepared:     diff.Prepared,
+		})
+	}
 }
 
 func saveJobLog(jobLogs chan dto.Message, job *models.Job, message string) {
@@ -261,29 +548,37 @@ func saveJobLog(jobLogs chan dto.Message, job *models.Job, message string) {
 func updateJobStatus(job *models.Job, status models.Status) error {
 	updates := make(map[string]interface{})
 	updates["status"] = status
+	run := getRun(job.ID)
 	switch status {
 	case models.StatusProcessing:
 		updates["started_at"] = time.Now()
-	case models.StatusCompleted:
+		if run != nil {
+			run.StartedAt = updates["started_at"].(time.Time)
+		}
+	case models.StatusCompleted, StatusPreviewed:
 		updates["finished_at"] = time.Now()
-	case models.StatusFailed:
+	case models.StatusFailed, StatusInterrupted, StatusCancelled, StatusTimedOut:
 		updates["finished_at"] = time.Now()
 	}
+	if finishedAt, ok := updates["finished_at"].(time.Time); ok && run != nil {
+		run.FinishedAt = finishedAt
+	}
 	err := models.UpdateJobStatus(job, updates)
 	if err != nil {
 		log.Printf("Failed to update job status: %s", err)
 		return err
 	}
-	amqpService.JobStatuses <- dto.NewStatusMessage(job.Type, job.ID, job.Status)
+	publishStatus(job)
 	return nil
 }
 
-func synchronizeProjectRepo(job *models.Job, jobLogs chan dto.Message) error {
+func synchronizeProjectRepo(ctx context.Context, job *models.Job, jobLogs chan dto.Message) error {
 	project := getProject(job)
 	if project == nil {
 		saveJobLog(jobLogs, job, fmt.Sprintf("Project not found"))
 		return fmt.Errorf("not found")
 	}
+	defer lockProject(project.ID)()
 	path := fmt.Sprintf("./storage/repositories/%d", project.ID)
 	var repo *git.Repository
 	var err error
@@ -300,9 +595,9 @@ func synchronizeProjectRepo(job *models.Job, jobLogs chan dto.Message) error {
 	}
 
 	if _, err = os.Stat(path); os.IsNotExist(err) {
-		repo, err = clone(project, jobLogs, keys, job)
+		repo, err = clone(ctx, project, jobLogs, keys, job)
 	} else {
-		repo, err = fetch(jobLogs, job, path, project, keys)
+		repo, err = fetch(ctx, jobLogs, job, path, project, keys)
 	}
 	if err != nil {
 		return err
@@ -328,12 +623,21 @@ func synchronizeProjectRepo(job *models.Job, jobLogs chan dto.Message) error {
 		saveJobLog(jobLogs, job, fmt.Sprintf("git reset: %s", err))
 		return err
 	}
+	if run := getRun(job.ID); run != nil {
+		run.Commit = hash.String()
+	}
 
 	saveJobLog(jobLogs, job, "Repository up to date")
 	return nil
 }
 
 func getProject(job *models.Job) *models.Project {
+	return models.GetProject(jobProjectID(job))
+}
+
+// jobProjectID returns the ID of the project of the job. The project of the inventory takes precedence
+// over the project of the application and the project of the job.
+func jobProjectID(job *models.Job) uint {
 	var projectID uint
 	if job.ProjectID != 0 {
 		projectID = job.ProjectID
@@ -344,23 +648,35 @@ func getProject(job *models.Job) *models.Project {
 	if job.Inventory.ProjectID != 0 {
 		projectID = job.Inventory.ProjectID
 	}
-	return models.GetProject(projectID)
+	return projectID
 }
 
+// getKey returns the repository credentials of the project. Encrypted keys are decrypted in memory with their passphrases.
 func getKey(project *models.Project, jobLogs chan dto.Message, job *models.Job) (*ssh.PublicKeys, error) {
 	if project.SshKeyID != 0 {
-		keys, err := ssh.NewPublicKeys(project.RepoUser, []byte(project.SshKey.Key), "")
+		passphrase, err := workerModels.GetSshKeyPassphrase(project.SshKeyID)
+		if err != nil {
+			saveJobLog(jobLogs, job, fmt.Sprintf("Cannot get passphrase of key %s: %s", project.SshKey.Title, err))
+			return nil, err
+		}
+		privateKey, err := parsePrivateKey(&project.SshKey, passphrase)
 		if err != nil {
 			saveJobLog(jobLogs, job, fmt.Sprintf("NewPublicKeys: %s", err))
 			return nil, err
 		}
+		signer, err := ssh2.NewSignerFromKey(privateKey)
+		if err != nil {
+			saveJobLog(jobLogs, job, fmt.Sprintf("NewPublicKeys: %s", err))
+			return nil, err
+		}
+		keys := &ssh.PublicKeys{User: project.RepoUser, Signer: signer}
 		keys.HostKeyCallback = ssh2.InsecureIgnoreHostKey()
 		return keys, nil
 	}
 	return nil, nil
 }
 
-func fetch(jobLogs chan dto.Message, job *models.Job, path string, project *models.Project, keys *ssh.PublicKeys) (*git.Repository, error) {
+func fetch(ctx context.Context, jobLogs chan dto.Message, job *models.Job, path string, project *models.Project, keys *ssh.PublicKeys) (*git.Repository, error) {
 	saveJobLog(jobLogs, job, "git open")
 	repo, err := git.PlainOpen(path)
 	if err != nil {
@@ -369,13 +685,13 @@ func fetch(jobLogs chan dto.Message, job *models.Job, path string, project *mode
 	}
 	saveJobLog(jobLogs, job, fmt.Sprintf("git fetch %s", project.RepoUrl))
 	if project.SshKeyID != 0 {
-		err = repo.Fetch(&git.FetchOptions{
+		err = repo.FetchContext(ctx, &git.FetchOptions{
 			Progress:   utils.NewChanWriter(jobLogs),
 			RemoteName: "origin",
 			Auth:       keys,
 		})
 	} else {
-		err = repo.Fetch(&git.FetchOptions{
+		err = repo.FetchContext(ctx, &git.FetchOptions{
 			Progress:   utils.NewChanWriter(jobLogs),
 			RemoteName: "origin",
 		})
@@ -387,18 +703,18 @@ func fetch(jobLogs chan dto.Message, job *models.Job, path string, project *mode
 	return repo, nil
 }
 
-func clone(project *models.Project, jobLogs chan dto.Message, keys *ssh.PublicKeys, job *models.Job) (*git.Repository, error) {
+func clone(ctx context.Context, project *models.Project, jobLogs chan dto.Message, keys *ssh.PublicKeys, job *models.Job) (*git.Repository, error) {
 	saveJobLog(jobLogs, job, fmt.Sprintf("git clone %s", project.RepoUrl))
 	var repo *git.Repository
 	var err error
 	if project.SshKeyID != 0 {
-		repo, err = git.PlainClone(fmt.Sprintf("./storage/repositories/%d", project.ID), false, &git.CloneOptions{
+		repo, err = git.PlainCloneContext(ctx, fmt.Sprintf("./storage/repositories/%d", project.ID), false, &git.CloneOptions{
 			URL:      project.RepoUrl,
 			Progress: utils.NewChanWriter(jobLogs),
 			Auth:     keys,
 		})
 	} else {
-		repo, err = git.PlainClone(fmt.Sprintf("./storage/repositories/%d", project.ID), false, &git.CloneOptions{
+		repo, err = git.PlainCloneContext(ctx, fmt.Sprintf("./storage/repositories/%d", project.ID), false, &git.CloneOptions{
 			URL:      project.RepoUrl,
 			Progress: utils.NewChanWriter(jobLogs),
 		})
@@ -423,11 +739,14 @@ func generateHtml(job *models.Job, title string, notificationType templates.Noti
 		JobID:       fmt.Sprintf("#%d", job.ID),
 		JobStart:    job.StartedAt,
 		JobLogs:     logs,
+		Hosts:       workerModels.GetJobHostResults(job.ID),
+		Preview:     isPreview(job),
+		Options:     jobOptions(job),
 	}.Html()
 }
 
 func generateText(job *models.Job, notificationType templates.NotificationType) string {
-	return fmt.Sprintf(
+	text := fmt.Sprintf(
 		"status: %s\nId: %d\ntype: %s\napplication: %s\ninventory: %s\nversion: %s",
 		notificationType,
 		job.ID,
@@ -435,10 +754,34 @@ func generateText(job *models.Job, notificationType templates.NotificationType)
 		job.Application.Name,
 		job.Inventory.Name,
 		job.Version)
+	if options := jobOptions(job); options != "" {
+		text += fmt.Sprintf("\noptions: %s", options)
+	}
+	if isPreview(job) {
+		text += "\npreview: changes were not applied"
+	}
+	return text
+}
+
+// jobOptions describes playbook options of the job, it is empty when the defaults are used.
+func jobOptions(job *models.Job) string {
+	if run := getRun(job.ID); run != nil {
+		return run.Options
+	}
+	return ""
+}
+
+// isPreview reports whether the job runs in check mode.
+func isPreview(job *models.Job) bool {
+	run := getRun(job.ID)
+	return run != nil && run.Preview
 }
 
 func sendNotification(job *models.Job, notificationType templates.NotificationType, jobLogs chan dto.Message) {
 	title := fmt.Sprintf("Deploji job #%d %s", job.ID, notificationType)
+	if isPreview(job) {
+		title = fmt.Sprintf("Deploji job #%d preview %s", job.ID, notificationType)
+	}
 	html := generateHtml(job, title, notificationType)
 	text := generateText(job, notificationType)
 	emails, webHooks, webPushes := getRecipients(job, notificationType)
@@ -460,6 +803,20 @@ func sendNotification(job *models.Job, notificationType templates.NotificationTy
 	}
 }
 
+// sendFinishedNotification notifies about the final status of the job.
+func sendFinishedNotification(job *models.Job, jobLogs chan dto.Message) {
+	switch job.Status {
+	case models.StatusCompleted, StatusPreviewed:
+		sendNotification(job, templates.NotificationTypeSuccess, jobLogs)
+	case StatusCancelled:
+		sendNotification(job, templates.NotificationTypeCancel, jobLogs)
+	case StatusTimedOut:
+		sendNotification(job, templates.NotificationTypeTimeout, jobLogs)
+	default:
+		sendNotification(job, templates.NotificationTypeFail, jobLogs)
+	}
+}
+
 func getRecipients(job *models.Job, notificationType templates.NotificationType) (emails map[string]string, webHooks map[string]string, webPushes []string) {
 	err, relatedNotifications := models.GetRelatedNotifications(*job)
 	if err != nil {
@@ -500,6 +857,8 @@ func getRecipients(job *models.Job, notificationType templates.NotificationType)
 
 func notificationEnabled(notificationType templates.NotificationType, notification models.RelatedNotification) bool {
 	return (notificationType == templates.NotificationTypeFail && notification.FailEnabled) ||
+		(notificationType == templates.NotificationTypeCancel && notification.FailEnabled) ||
+		(notificationType == templates.NotificationTypeTimeout && notification.FailEnabled) ||
 		(notificationType == templates.NotificationTypeSuccess && notification.SuccessEnabled) ||
 		(notificationType == templates.NotificationTypeStart && notification.StartEnabled)
 }
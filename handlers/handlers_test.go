@@ -0,0 +1,72 @@
+package handlers
+
+import (
+	"github.com/deploji/deploji-server/models"
+	"github.com/deploji/deploji-worker/workerModels"
+	"testing"
+	"time"
+)
+
+func TestFindOwner(t *testing.T) {
+	now := time.Now()
+	heartbeats := []*workerModels.WorkerHeartbeat{
+		workerModels.NewWorkerHeartbeat("worker-a", now, false, []uint{7, 12}),
+		workerModels.NewWorkerHeartbeat("worker-b", now, false, []uint{120}),
+		workerModels.NewWorkerHeartbeat("worker-c", now, false, nil),
+	}
+	if owner := findOwner(heartbeats, 12, "worker-c"); owner != "worker-a" {
+		t.Errorf("expected worker-a, got %q", owner)
+	}
+	if owner := findOwner(heartbeats, 120, "worker-c"); owner != "worker-b" {
+		t.Errorf("expected worker-b, got %q", owner)
+	}
+	if owner := findOwner(heartbeats, 1, "worker-c"); owner != "" {
+		t.Errorf("expected no owner of job 1, got %q", owner)
+	}
+	if owner := findOwner(heartbeats, 7, "worker-a"); owner != "" {
+		t.Errorf("expected own heartbeat to be skipped, got %q", owner)
+	}
+}
+
+func TestJobProjectID(t *testing.T) {
+	job := &models.Job{ProjectID: 3}
+	if id := jobProjectID(job); id != 3 {
+		t.Errorf("expected project of the job, got %d", id)
+	}
+	job.Application.ProjectID = 5
+	if id := jobProjectID(job); id != 5 {
+		t.Errorf("expected project of the application, got %d", id)
+	}
+	job.Inventory.ProjectID = 7
+	if id := jobProjectID(job); id != 7 {
+		t.Errorf("expected project of the inventory, got %d", id)
+	}
+}
+
+func TestPreviewDoesNotCompleteDeployment(t *testing.T) {
+	if status := previewStatus(models.StatusCompleted, true); status == models.StatusCompleted || status != StatusPreviewed {
+		t.Errorf("expected successful preview to finish as previewed, got %d", status)
+	}
+	if !successful(previewStatus(models.StatusCompleted, true)) {
+		t.Error("expected previewed status to be successful")
+	}
+	if status := previewStatus(models.StatusFailed, true); status != models.StatusFailed {
+		t.Errorf("expected failed preview to stay failed, got %d", status)
+	}
+	if status := previewStatus(models.StatusCompleted, false); status != models.StatusCompleted {
+		t.Errorf("expected deployment to complete, got %d", status)
+	}
+}
+
+func TestValidateJobMessageRetryPolicy(t *testing.T) {
+	job := &JobMessage{Retry: &RetryPolicy{MaxAttempts: -1}}
+	job.ID = 1
+	job.Type = models.TypeDeployment
+	if err := validateJobMessage(job); err == nil {
+		t.Error("job with an out of range retry policy should be rejected")
+	}
+	job.Retry = &RetryPolicy{MaxAttempts: 3, Backoff: 10}
+	if err := validateJobMessage(job); err != nil {
+		t.Errorf("job with a valid retry policy should be accepted: %s", err)
+	}
+}
@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"github.com/deploji/deploji-server/dto"
+	"github.com/deploji/deploji-worker/utils"
+	"time"
+)
+
+// JobMessage is the job message received from the server together with options of the run.
+type JobMessage struct {
+	dto.JobMessage
+	PlaybookOptions
+	// Label restricts the job to workers having the label, such jobs are published to the label queue.
+	Label string
+	// Timeout of the job in seconds, JOB_TIMEOUT is used when it is not set. Zero means no timeout.
+	Timeout uint
+	// Retry overrides the retry policy of the worker.
+	Retry *RetryPolicy
+	// Preview runs the playbook with --check and --diff, reporting changes without applying them.
+	Preview bool
+	// Environment is the execution environment of the project, the ansible installed on the worker is used when it is nil.
+	Environment *ExecutionEnvironment
+	// KeyIDs are machine credentials loaded into the ssh-agent of the run in addition to the key of the job.
+	KeyIDs []uint
+	// VaultIDs are labeled vault credentials passed in addition to the vault key of the job.
+	VaultIDs []VaultID
+}
+
+// validateOptions checks options of the run.
+func (m *JobMessage) validateOptions() error {
+	if err := m.PlaybookOptions.validate(); err != nil {
+		return err
+	}
+	if err := validateVaultIDs(m.VaultIDs); err != nil {
+		return err
+	}
+	if m.Environment != nil {
+		return m.Environment.validate()
+	}
+	return nil
+}
+
+// retryPolicy returns the retry policy of the job.
+func (m *JobMessage) retryPolicy() RetryPolicy {
+	if m.Retry != nil {
+		return *m.Retry
+	}
+	return defaultRetryPolicy()
+}
+
+// timeout returns the execution timeout of the job.
+func (m *JobMessage) timeout() time.Duration {
+	if m.Timeout > 0 {
+		return time.Duration(m.Timeout) * time.Second
+	}
+	return time.Duration(utils.GetEnvInt("JOB_TIMEOUT", 0)) * time.Second
+}
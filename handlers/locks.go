@@ -0,0 +1,28 @@
+package handlers
+
+import (
+	"sync"
+)
+
+// keyedLocks serializes work on the same resource, e.g. a project repository, between concurrently running jobs.
+type keyedLocks struct {
+	mutex sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+func newKeyedLocks() *keyedLocks {
+	return &keyedLocks{locks: make(map[string]*sync.Mutex)}
+}
+
+// lock locks the key and returns the function unlocking it.
+func (l *keyedLocks) lock(key string) func() {
+	l.mutex.Lock()
+	lock, ok := l.locks[key]
+	if !ok {
+		lock = &sync.Mutex{}
+		l.locks[key] = lock
+	}
+	l.mutex.Unlock()
+	lock.Lock()
+	return lock.Unlock
+}
@@ -0,0 +1,196 @@
+package handlers
+
+import (
+	"fmt"
+	"github.com/deploji/deploji-server/dto"
+	"github.com/deploji/deploji-server/models"
+	"github.com/deploji/deploji-worker/utils"
+	"golang.org/x/net/context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// playbookSpec describes an ansible-playbook run of a job.
+type playbookSpec struct {
+	Job *models.Job
+	// AgentSocket is the socket of the ssh-agent holding keys of the job.
+	AgentSocket string
+	// VaultIDs are vault password files of the job.
+	VaultIDs []vaultIDFile
+	// ExtraVarsFile is the file with extra variables of the job.
+	ExtraVarsFile string
+	Preview       bool
+	Options       PlaybookOptions
+	// Env is added to the base environment, e.g. paths of installed Galaxy requirements.
+	Env []string
+	// BinDir is the bin directory of the execution environment, empty for the ansible installed on the worker.
+	BinDir string
+	// Dir is the workspace the playbook runs in.
+	Dir string
+}
+
+// playbookCommand is the ansible-playbook command of a job together with its environment and working directory.
+type playbookCommand struct {
+	Args []string
+	Env  []string
+	Dir  string
+}
+
+// playbookEnv is the base environment of ansible-playbook processes.
+var playbookEnv = []string{
+	"ANSIBLE_FORCE_COLOR=true",
+	"ANSIBLE_HOST_KEY_CHECKING=False",
+	"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
+}
+
+// playbookEnvironment returns the base environment with the bin directory of the execution environment,
+// if any, prepended to PATH.
+func playbookEnvironment(binDir string) []string {
+	env := append([]string(nil), playbookEnv...)
+	if binDir == "" {
+		return env
+	}
+	for i, variable := range env {
+		if strings.HasPrefix(variable, "PATH=") {
+			env[i] = fmt.Sprintf("PATH=%s%c%s", binDir, os.PathListSeparator, strings.TrimPrefix(variable, "PATH="))
+		}
+	}
+	return append(env, fmt.Sprintf("VIRTUAL_ENV=%s", filepath.Dir(binDir)))
+}
+
+// ansibleExecutable returns the path of an Ansible command. Commands are looked up in PATH of the worker
+// rather than the environment of the command, so commands of execution environments are referenced by path.
+func ansibleExecutable(binDir string, name string) string {
+	if binDir == "" {
+		return name
+	}
+	return filepath.Join(binDir, name)
+}
+
+// newPlaybookCommand builds the command running the playbook of the spec. Deployments additionally get
+// the application and version variables.
+func newPlaybookCommand(spec playbookSpec) playbookCommand {
+	job := spec.Job
+	args := []string{ansibleExecutable(spec.BinDir, "ansible-playbook")}
+	args = append(args, "-i", job.Inventory.SourceFile)
+	if job.Type == models.TypeDeployment {
+		args = append(args, "-e", fmt.Sprintf("app=%s", job.Application.AnsibleName), "-e", fmt.Sprintf("version=%s", job.Version))
+	}
+	args = append(args, "-e", "@"+spec.ExtraVarsFile, job.Playbook)
+	for _, vaultID := range spec.VaultIDs {
+		args = append(args, "--vault-id", vaultID.arg())
+	}
+	if spec.Preview {
+		args = append(args, "--check", "--diff")
+	}
+	args = append(args, spec.Options.args()...)
+	env := append(playbookEnvironment(spec.BinDir), spec.Env...)
+	if spec.AgentSocket != "" {
+		env = append(env, fmt.Sprintf("SSH_AUTH_SOCK=%s", spec.AgentSocket))
+	}
+	return playbookCommand{
+		Args: args,
+		Env:  env,
+		Dir:  spec.Dir,
+	}
+}
+
+func (c playbookCommand) command() *exec.Cmd {
+	cmd := exec.Command(c.Args[0], c.Args[1:]...)
+	cmd.Env = append([]string(nil), c.Env...)
+	cmd.Dir = c.Dir
+	return cmd
+}
+
+// runPlaybook synchronizes the project and runs the playbook of the job once, in the workspace of the job.
+func runPlaybook(ctx context.Context, message *JobMessage, job *models.Job, jobLogs chan dto.Message) FailureClass {
+	if err := synchronizeProjectRepo(ctx, job, jobLogs); err != nil {
+		saveJobLog(jobLogs, job, fmt.Sprintf("Cannot synchronize project: %s", err))
+		return FailureSCM
+	}
+	workspace, err := createWorkspace(job, getRun(job.ID).Commit, jobLogs)
+	if err != nil {
+		saveJobLog(jobLogs, job, fmt.Sprintf("Cannot create workspace: %s", err))
+		return FailureStart
+	}
+	binDir, err := prepareEnvironment(ctx, message.Environment, job, jobLogs)
+	if err != nil {
+		saveJobLog(jobLogs, job, fmt.Sprintf("Cannot prepare execution environment: %s", err))
+		return FailureEnvironment
+	}
+	galaxyEnv, err := installGalaxyRequirements(ctx, job, jobLogs, workspace, binDir)
+	if err != nil {
+		saveJobLog(jobLogs, job, fmt.Sprintf("Cannot install Galaxy requirements: %s", err))
+		return FailureGalaxy
+	}
+	secrets, err := utils.NewSecrets(fmt.Sprintf("job-%d", job.ID))
+	if err != nil {
+		saveJobLog(jobLogs, job, fmt.Sprintf("Cannot create secrets directory: %s", err))
+		return FailureStart
+	}
+	defer removeSecrets(job, secrets)
+	sshAgent, err := startSSHAgent(secrets.Dir)
+	if err != nil {
+		saveJobLog(jobLogs, job, fmt.Sprintf("Cannot start SSH agent: %s", err))
+		return FailureStart
+	}
+	defer sshAgent.close()
+	if err := loadKeys(job, message.KeyIDs, sshAgent); err != nil {
+		saveJobLog(jobLogs, job, fmt.Sprintf("Cannot load key: %s", err))
+		return FailureStart
+	}
+	vaultIDs, err := writeVaultKeys(job, message.VaultIDs, secrets)
+	if err != nil {
+		saveJobLog(jobLogs, job, fmt.Sprintf("Cannot write vault key: %s", err))
+		return FailureStart
+	}
+	extraVariables := fmt.Sprintf("%s\ndeploji_worker: true\n", job.ExtraVariables)
+	extraVarsFile, err := secrets.Write("extra-vars.yml", extraVariables)
+	if err != nil {
+		saveJobLog(jobLogs, job, fmt.Sprintf("Cannot write extra vars: %s", err))
+		return FailureStart
+	}
+	saveJobLog(jobLogs, job, fmt.Sprintf("extra vars: \n%s", extraVariables))
+
+	if message.Preview {
+		saveJobLog(jobLogs, job, "Preview run, changes are not applied")
+	}
+	if options := message.PlaybookOptions.String(); options != "" {
+		saveJobLog(jobLogs, job, fmt.Sprintf("Playbook options: %s", options))
+	}
+	cmd := newPlaybookCommand(playbookSpec{
+		Job:           job,
+		AgentSocket:   sshAgent.Socket,
+		VaultIDs:      vaultIDs,
+		ExtraVarsFile: extraVarsFile,
+		Preview:       message.Preview,
+		Options:       message.PlaybookOptions,
+		Env:           galaxyEnv,
+		BinDir:        binDir,
+		Dir:           workspace,
+	}).command()
+	saveJobLog(jobLogs, job, strings.Join(cmd.Args, " "))
+	saveJobLog(jobLogs, job, fmt.Sprintf("cmd.Dir %s", cmd.Dir))
+	setProcessGroup(cmd)
+	pipes := processPipes(cmd, jobLogs, job)
+	events := processEvents(cmd, jobLogs, job, pipes)
+
+	err = cmd.Start()
+	if events != nil {
+		events.Close()
+	}
+	if err != nil {
+		saveJobLog(jobLogs, job, fmt.Sprintf("Cannot start command: %s", err))
+		return FailureStart
+	}
+
+	err = waitCommand(ctx, cmd, pipes)
+	recordExitCode(job, cmd)
+	if err != nil {
+		saveJobLog(jobLogs, job, fmt.Sprintf("Error waiting for process: %s", err))
+		return commandFailure(err)
+	}
+	return ""
+}
@@ -0,0 +1,123 @@
+package handlers
+
+import (
+	"fmt"
+	"github.com/deploji/deploji-worker/utils"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// PlaybookOptions are optional ansible-playbook arguments of a job.
+type PlaybookOptions struct {
+	// Limit restricts the run to hosts matching the pattern.
+	Limit string
+	// Tags and SkipTags are comma separated lists of tags.
+	Tags     string
+	SkipTags string
+	// Forks is the number of parallel processes, the ansible default is used when it is zero.
+	Forks int
+	// Verbosity is the number of -v flags, from 0 to 4.
+	Verbosity   int
+	StartAtTask string
+}
+
+const (
+	maxVerbosity    = 4
+	maxOptionLength = 1024
+)
+
+var (
+	limitPattern = regexp.MustCompile(`^[\w.:,&!*?~^$@\[\]\-]+$`)
+	tagsPattern  = regexp.MustCompile(`^[\w.:\- ]+(,[\w.:\- ]+)*$`)
+)
+
+// validate checks the options can be passed to ansible-playbook. Limit patterns reading hosts from a file are rejected,
+// the file would be read on the worker.
+func (o PlaybookOptions) validate() error {
+	if o.Limit != "" && (!limitPattern.MatchString(o.Limit) || readsHostsFile(o.Limit)) {
+		return fmt.Errorf("invalid limit: %q", o.Limit)
+	}
+	if o.Tags != "" && !tagsPattern.MatchString(o.Tags) {
+		return fmt.Errorf("invalid tags: %q", o.Tags)
+	}
+	if o.SkipTags != "" && !tagsPattern.MatchString(o.SkipTags) {
+		return fmt.Errorf("invalid skip tags: %q", o.SkipTags)
+	}
+	if maxForks := utils.GetEnvInt("MAX_FORKS", 50); o.Forks < 0 || o.Forks > maxForks {
+		return fmt.Errorf("forks must be between 0 and %d, got %d", maxForks, o.Forks)
+	}
+	if o.Verbosity < 0 || o.Verbosity > maxVerbosity {
+		return fmt.Errorf("verbosity must be between 0 and %d, got %d", maxVerbosity, o.Verbosity)
+	}
+	for _, r := range o.StartAtTask {
+		if unicode.IsControl(r) {
+			return fmt.Errorf("invalid start at task: %q", o.StartAtTask)
+		}
+	}
+	for _, option := range []string{o.Limit, o.Tags, o.SkipTags, o.StartAtTask} {
+		if len(option) > maxOptionLength {
+			return fmt.Errorf("option longer than %d characters", maxOptionLength)
+		}
+	}
+	return nil
+}
+
+// readsHostsFile reports whether a pattern of the limit is a file of hosts, i.e. it starts with @.
+func readsHostsFile(limit string) bool {
+	for _, pattern := range strings.FieldsFunc(limit, func(r rune) bool { return r == ',' || r == ':' }) {
+		if strings.HasPrefix(strings.TrimLeft(pattern, "&!"), "@") {
+			return true
+		}
+	}
+	return false
+}
+
+// args returns ansible-playbook arguments of the options. Values are joined with their flags,
+// so they cannot be taken for other flags.
+func (o PlaybookOptions) args() []string {
+	var args []string
+	if o.Limit != "" {
+		args = append(args, "--limit="+o.Limit)
+	}
+	if o.Tags != "" {
+		args = append(args, "--tags="+o.Tags)
+	}
+	if o.SkipTags != "" {
+		args = append(args, "--skip-tags="+o.SkipTags)
+	}
+	if o.Forks > 0 {
+		args = append(args, fmt.Sprintf("--forks=%d", o.Forks))
+	}
+	if o.StartAtTask != "" {
+		args = append(args, "--start-at-task="+o.StartAtTask)
+	}
+	if o.Verbosity > 0 {
+		args = append(args, "-"+strings.Repeat("v", o.Verbosity))
+	}
+	return args
+}
+
+// String describes options which are set, it is empty when the defaults are used.
+func (o PlaybookOptions) String() string {
+	var options []string
+	if o.Limit != "" {
+		options = append(options, fmt.Sprintf("limit: %s", o.Limit))
+	}
+	if o.Tags != "" {
+		options = append(options, fmt.Sprintf("tags: %s", o.Tags))
+	}
+	if o.SkipTags != "" {
+		options = append(options, fmt.Sprintf("skip tags: %s", o.SkipTags))
+	}
+	if o.Forks > 0 {
+		options = append(options, fmt.Sprintf("forks: %d", o.Forks))
+	}
+	if o.StartAtTask != "" {
+		options = append(options, fmt.Sprintf("start at task: %s", o.StartAtTask))
+	}
+	if o.Verbosity > 0 {
+		options = append(options, fmt.Sprintf("verbosity: %d", o.Verbosity))
+	}
+	return strings.Join(options, ", ")
+}
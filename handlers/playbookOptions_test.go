@@ -0,0 +1,47 @@
+package handlers
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPlaybookOptionsArgs(t *testing.T) {
+	options := PlaybookOptions{
+		Limit:       "web:&staging",
+		Tags:        "deploy,config",
+		SkipTags:    "slow",
+		Forks:       10,
+		Verbosity:   2,
+		StartAtTask: "Restart nginx",
+	}
+	if err := options.validate(); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"--limit=web:&staging", "--tags=deploy,config", "--skip-tags=slow", "--forks=10", "--start-at-task=Restart nginx", "-vv"}
+	if args := options.args(); !reflect.DeepEqual(args, expected) {
+		t.Errorf("expected %v, got %v", expected, args)
+	}
+	if args := (PlaybookOptions{}).args(); args != nil {
+		t.Errorf("expected no args, got %v", args)
+	}
+}
+
+func TestPlaybookOptionsValidate(t *testing.T) {
+	invalid := []PlaybookOptions{
+		{Limit: "@/etc/passwd"},
+		{Limit: "web,@hosts.txt"},
+		{Limit: "web:!@hosts.txt"},
+		{Limit: "web --private-key=/tmp/key"},
+		{Tags: "deploy;rm"},
+		{SkipTags: ",deploy"},
+		{Forks: -1},
+		{Forks: 1000},
+		{Verbosity: 5},
+		{StartAtTask: "Restart\nnginx"},
+	}
+	for _, options := range invalid {
+		if err := options.validate(); err == nil {
+			t.Errorf("expected %+v to be invalid", options)
+		}
+	}
+}
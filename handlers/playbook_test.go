@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"github.com/deploji/deploji-server/models"
+	"reflect"
+	"testing"
+)
+
+func TestNewPlaybookCommand(t *testing.T) {
+	job := &models.Job{
+		Type:      models.TypeJob,
+		Inventory: models.Inventory{SourceFile: "inventories/staging", ProjectID: 7},
+		Playbook:  "site.yml",
+	}
+	command := newPlaybookCommand(playbookSpec{
+		Job:           job,
+		ExtraVarsFile: "/dev/shm/deploji-secrets-job-12/extra-vars.yml",
+		Dir:           "/storage/workspaces/12",
+	})
+	expected := []string{
+		"ansible-playbook", "-i", "inventories/staging",
+		"-e", "@/dev/shm/deploji-secrets-job-12/extra-vars.yml", "site.yml",
+	}
+	if !reflect.DeepEqual(command.Args, expected) {
+		t.Errorf("expected %v, got %v", expected, command.Args)
+	}
+	if command.Dir != "/storage/workspaces/12" {
+		t.Errorf("unexpected dir %s", command.Dir)
+	}
+	if !reflect.DeepEqual(command.Env, playbookEnv) {
+		t.Errorf("unexpected env %v", command.Env)
+	}
+}
+
+func TestNewPlaybookCommandDeployment(t *testing.T) {
+	job := &models.Job{
+		Type:        models.TypeDeployment,
+		Inventory:   models.Inventory{SourceFile: "inventories/production", ProjectID: 7},
+		Application: models.Application{AnsibleName: "shop"},
+		Version:     "1.2.0",
+		Playbook:    "deploy.yml",
+	}
+	command := newPlaybookCommand(playbookSpec{
+		Job:         job,
+		AgentSocket: "/secrets/agent.sock",
+		VaultIDs: []vaultIDFile{
+			{Path: "/secrets/vault-key"},
+			{Label: "prod", Path: "/secrets/vault-key-prod"},
+		},
+		ExtraVarsFile: "/secrets/extra-vars.yml",
+		Preview:       true,
+		Options:       PlaybookOptions{Limit: "web", Verbosity: 1},
+		Env:           []string{"ANSIBLE_ROLES_PATH=/cache/roles"},
+	})
+	expected := []string{
+		"ansible-playbook", "-i", "inventories/production",
+		"-e", "app=shop", "-e", "version=1.2.0", "-e", "@/secrets/extra-vars.yml", "deploy.yml",
+		"--vault-id", "/secrets/vault-key", "--vault-id", "prod@/secrets/vault-key-prod", "--check", "--diff", "--limit=web", "-v",
+	}
+	if !reflect.DeepEqual(command.Args, expected) {
+		t.Errorf("expected %v, got %v", expected, command.Args)
+	}
+	env := command.Env[len(command.Env)-2:]
+	if !reflect.DeepEqual(env, []string{"ANSIBLE_ROLES_PATH=/cache/roles", "SSH_AUTH_SOCK=/secrets/agent.sock"}) {
+		t.Errorf("expected spec env and agent socket to be appended, got %v", command.Env)
+	}
+}
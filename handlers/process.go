@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"golang.org/x/net/context"
+	"log"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// processKillTimeout is the time a process gets to exit after SIGTERM before it is killed.
+const processKillTimeout = 10 * time.Second
+
+// waitCommand waits for the started command and its output pipes. When ctx is cancelled
+// before the command exits, the process group is terminated.
+func waitCommand(ctx context.Context, cmd *exec.Cmd, pipes *sync.WaitGroup) error {
+	exited := make(chan struct{})
+	defer close(exited)
+	go func() {
+		select {
+		case <-exited:
+		case <-ctx.Done():
+			terminate(cmd, exited)
+		}
+	}()
+	pipes.Wait()
+	return cmd.Wait()
+}
+
+// terminate sends SIGTERM to the process group of the command and kills it
+// if it is still running after processKillTimeout.
+func terminate(cmd *exec.Cmd, exited <-chan struct{}) {
+	if cmd.Process == nil {
+		return
+	}
+	log.Printf("Terminating process group %d", cmd.Process.Pid)
+	if err := signalProcessGroup(cmd, syscall.SIGTERM); err != nil {
+		log.Printf("Cannot terminate process group %d: %s", cmd.Process.Pid, err)
+		cmd.Process.Kill()
+		return
+	}
+	select {
+	case <-exited:
+	case <-time.After(processKillTimeout):
+		log.Printf("Killing process group %d", cmd.Process.Pid)
+		if err := signalProcessGroup(cmd, syscall.SIGKILL); err != nil {
+			cmd.Process.Kill()
+		}
+	}
+}
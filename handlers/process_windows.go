@@ -0,0 +1,18 @@
+//go:build windows
+// +build windows
+
+package handlers
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup is a no-op, process groups are not supported on Windows.
+func setProcessGroup(cmd *exec.Cmd) {
+}
+
+// signalProcessGroup kills the process, Windows does not support sending signals.
+func signalProcessGroup(cmd *exec.Cmd, sig syscall.Signal) error {
+	return cmd.Process.Kill()
+}
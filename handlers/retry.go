@@ -0,0 +1,148 @@
+package handlers
+
+import (
+	"fmt"
+	"github.com/deploji/deploji-server/dto"
+	"github.com/deploji/deploji-server/models"
+	"github.com/deploji/deploji-worker/utils"
+	"golang.org/x/net/context"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// FailureClass categorizes the reason a job run failed.
+type FailureClass string
+
+const (
+	FailureSCM         FailureClass = "scm"
+	FailureGalaxy      FailureClass = "galaxy"
+	FailureEnvironment FailureClass = "environment"
+	FailureStart       FailureClass = "start"
+	FailureUnreachable FailureClass = "unreachable"
+	FailurePlaybook    FailureClass = "playbook"
+)
+
+// ansibleExitUnreachable is the exit code of ansible-playbook when some hosts were unreachable.
+const ansibleExitUnreachable = 4
+
+// commandFailure classifies the error returned by a finished ansible-playbook command.
+func commandFailure(err error) FailureClass {
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == ansibleExitUnreachable {
+		return FailureUnreachable
+	}
+	return FailurePlaybook
+}
+
+// RetryPolicy defines how failed jobs are retried.
+type RetryPolicy struct {
+	// MaxAttempts is the number of runs including the first one.
+	MaxAttempts int
+	// Backoff is the delay in seconds before the first retry, it doubles with every next retry.
+	Backoff int
+	// RetryOn lists failure classes which are retried.
+	RetryOn []FailureClass
+}
+
+// defaultRetryPolicy returns the policy configured by RETRY_MAX_ATTEMPTS, RETRY_BACKOFF and RETRY_ON variables.
+// By default jobs are not retried.
+func defaultRetryPolicy() RetryPolicy {
+	retryOn := os.Getenv("RETRY_ON")
+	if retryOn == "" {
+		retryOn = fmt.Sprintf("%s,%s,%s,%s", FailureSCM, FailureGalaxy, FailureEnvironment, FailureUnreachable)
+	}
+	policy := RetryPolicy{
+		MaxAttempts: utils.GetEnvInt("RETRY_MAX_ATTEMPTS", 1),
+		Backoff:     utils.GetEnvInt("RETRY_BACKOFF", 30),
+	}
+	for _, failure := range strings.Split(retryOn, ",") {
+		policy.RetryOn = append(policy.RetryOn, FailureClass(strings.TrimSpace(failure)))
+	}
+	return policy
+}
+
+// retries reports whether the attempt which failed with given failure should be retried.
+func (p RetryPolicy) retries(attempt int, failure FailureClass) bool {
+	if attempt >= p.MaxAttempts {
+		return false
+	}
+	for _, f := range p.RetryOn {
+		if f == failure {
+			return true
+		}
+	}
+	return false
+}
+
+// maxRetryAttempts returns the highest number of attempts a job can request, configured by MAX_RETRY_ATTEMPTS.
+func maxRetryAttempts() int {
+	return utils.GetEnvInt("MAX_RETRY_ATTEMPTS", 10)
+}
+
+// maxRetryBackoff returns the longest delay in seconds before a retry, configured by MAX_RETRY_BACKOFF.
+func maxRetryBackoff() int {
+	return utils.GetEnvInt("MAX_RETRY_BACKOFF", 3600)
+}
+
+// validate checks the policy requested by a job is in the range allowed by the worker.
+func (p RetryPolicy) validate() error {
+	if maxAttempts := maxRetryAttempts(); p.MaxAttempts < 1 || p.MaxAttempts > maxAttempts {
+		return fmt.Errorf("retry attempts must be between 1 and %d, got %d", maxAttempts, p.MaxAttempts)
+	}
+	if maxBackoff := maxRetryBackoff(); p.Backoff < 0 || p.Backoff > maxBackoff {
+		return fmt.Errorf("retry backoff must be between 0 and %d, got %d", maxBackoff, p.Backoff)
+	}
+	return nil
+}
+
+// delay returns the delay before the retry of given failed attempt, it is capped by MAX_RETRY_BACKOFF.
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	maxBackoff := maxRetryBackoff()
+	backoff := p.Backoff
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+	if backoff < 0 {
+		backoff = 0
+	}
+	maxDelay := time.Duration(maxBackoff) * time.Second
+	delay := time.Duration(backoff) * time.Second
+	for i := 1; i < attempt && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	return delay
+}
+
+// runWithRetries runs the job until it succeeds, fails with a failure not retried by the policy, runs out
+// of attempts or its context is cancelled. It returns the resulting job status.
+func runWithRetries(ctx context.Context, job *models.Job, jobLogs chan dto.Message, policy RetryPolicy, run func() FailureClass) models.Status {
+	state := getRun(job.ID)
+	state.MaxAttempts = policy.MaxAttempts
+	for attempt := 1; ; attempt++ {
+		state.Attempt = attempt
+		if attempt > 1 {
+			saveJobLog(jobLogs, job, fmt.Sprintf("Attempt %d of %d", attempt, policy.MaxAttempts))
+			publishStatus(job)
+		}
+		state.ExitCode = nil
+		state.Hosts = nil
+		state.Failure = run()
+		if state.Failure == "" {
+			return models.StatusCompleted
+		}
+		if ctx.Err() != nil || !policy.retries(attempt, state.Failure) {
+			return models.StatusFailed
+		}
+		delay := policy.delay(attempt)
+		saveJobLog(jobLogs, job, fmt.Sprintf("Attempt %d of %d failed (%s), retrying in %s", attempt, policy.MaxAttempts, state.Failure, delay))
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return models.StatusFailed
+		}
+	}
+}
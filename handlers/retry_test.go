@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 3, Backoff: 10, RetryOn: []FailureClass{FailureSCM, FailureUnreachable}}
+
+	if !policy.retries(1, FailureSCM) {
+		t.Error("scm failure of the first attempt should be retried")
+	}
+	if policy.retries(1, FailurePlaybook) {
+		t.Error("playbook failure should not be retried")
+	}
+	if policy.retries(3, FailureUnreachable) {
+		t.Error("last attempt should not be retried")
+	}
+	if delay := policy.delay(1); delay != 10*time.Second {
+		t.Errorf("expected delay 10s, got %s", delay)
+	}
+	if delay := policy.delay(3); delay != 40*time.Second {
+		t.Errorf("expected delay 40s, got %s", delay)
+	}
+}
+
+func TestRetryDelayCapped(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 100, Backoff: 30}
+	if delay := policy.delay(64); delay != time.Hour {
+		t.Errorf("expected delay capped at 1h, got %s", delay)
+	}
+	policy.Backoff = 1 << 62
+	if delay := policy.delay(2); delay != time.Hour {
+		t.Errorf("expected huge backoff capped at 1h, got %s", delay)
+	}
+}
+
+func TestRetryPolicyValidate(t *testing.T) {
+	valid := []RetryPolicy{
+		{MaxAttempts: 1},
+		{MaxAttempts: 10, Backoff: 3600},
+	}
+	for _, policy := range valid {
+		if err := policy.validate(); err != nil {
+			t.Errorf("policy %+v should be valid: %s", policy, err)
+		}
+	}
+	invalid := []RetryPolicy{
+		{MaxAttempts: 0},
+		{MaxAttempts: -1},
+		{MaxAttempts: 1 << 40},
+		{MaxAttempts: 3, Backoff: -5},
+		{MaxAttempts: 3, Backoff: 1 << 40},
+	}
+	for _, policy := range invalid {
+		if err := policy.validate(); err == nil {
+			t.Errorf("policy %+v should be invalid", policy)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"github.com/deploji/deploji-server/models"
+	"golang.org/x/crypto/ssh/agent"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// sshAgent is an in-process SSH agent serving keys of a single job over a unix socket.
+// Keys are kept in memory only, ansible-playbook and ssh reach them through SSH_AUTH_SOCK.
+type sshAgent struct {
+	Socket   string
+	keyring  agent.Agent
+	listener net.Listener
+	mutex    sync.Mutex
+	conns    map[net.Conn]struct{}
+	served   sync.WaitGroup
+}
+
+// startSSHAgent starts an agent listening on a socket in dir, which should be readable only by the worker user.
+func startSSHAgent(dir string) (*sshAgent, error) {
+	socket := filepath.Join(dir, "agent.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(socket, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	a := &sshAgent{
+		Socket:   socket,
+		keyring:  agent.NewKeyring(),
+		listener: listener,
+		conns:    make(map[net.Conn]struct{}),
+	}
+	a.served.Add(1)
+	go a.serve()
+	return a, nil
+}
+
+func (a *sshAgent) serve() {
+	defer a.served.Done()
+	for {
+		conn, err := a.listener.Accept()
+		if err != nil {
+			return
+		}
+		a.mutex.Lock()
+		a.conns[conn] = struct{}{}
+		a.mutex.Unlock()
+		a.served.Add(1)
+		go func() {
+			defer a.served.Done()
+			agent.ServeAgent(a.keyring, conn)
+			a.mutex.Lock()
+			delete(a.conns, conn)
+			a.mutex.Unlock()
+			conn.Close()
+		}()
+	}
+}
+
+// add decodes the private key, decrypting it with the passphrase if any, and adds it to the agent.
+func (a *sshAgent) add(key *models.SshKey, passphrase string) error {
+	privateKey, err := parsePrivateKey(key, passphrase)
+	if err != nil {
+		return err
+	}
+	return a.keyring.Add(agent.AddedKey{PrivateKey: privateKey, Comment: key.Title})
+}
+
+// close stops the agent, removes its keys and closes connections of processes which are still connected.
+func (a *sshAgent) close() {
+	a.listener.Close()
+	if err := a.keyring.RemoveAll(); err != nil {
+		log.Printf("Cannot remove keys from SSH agent: %s", err)
+	}
+	a.mutex.Lock()
+	for conn := range a.conns {
+		conn.Close()
+	}
+	a.mutex.Unlock()
+	a.served.Wait()
+}
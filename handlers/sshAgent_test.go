@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"github.com/deploji/deploji-server/models"
+	"golang.org/x/crypto/ssh/agent"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+)
+
+func newTestKey(t *testing.T, title string) *models.SshKey {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}
+	return &models.SshKey{Title: title, Key: models.Key(pem.EncodeToMemory(block))}
+}
+
+func TestSSHAgent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sshAgent, err := startSSHAgent(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, title := range []string{"deploy", "bastion"} {
+		if err := sshAgent.add(newTestKey(t, title), ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sshAgent.add(&models.SshKey{Title: "broken", Key: "not a key"}, ""); err == nil {
+		t.Error("expected error adding invalid key")
+	}
+
+	conn, err := net.Dial("unix", sshAgent.Socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := agent.NewClient(conn).List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0].Comment != "deploy" || keys[1].Comment != "bastion" {
+		t.Errorf("unexpected keys %v", keys)
+	}
+
+	sshAgent.close()
+	if _, err := agent.NewClient(conn).List(); err == nil {
+		t.Error("expected connection to be closed with the agent")
+	}
+	if _, err := net.Dial("unix", sshAgent.Socket); err == nil {
+		t.Error("expected agent to stop listening")
+	}
+}
@@ -0,0 +1,27 @@
+package handlers
+
+import (
+	"fmt"
+	"github.com/deploji/deploji-server/models"
+	"golang.org/x/crypto/ssh"
+)
+
+// parsePrivateKey decodes the private key, decrypting it with the passphrase when it is not empty.
+// Decrypted keys are kept in memory only.
+func parsePrivateKey(key *models.SshKey, passphrase string) (interface{}, error) {
+	if passphrase != "" {
+		privateKey, err := ssh.ParseRawPrivateKeyWithPassphrase([]byte(key.Key), []byte(passphrase))
+		if err != nil {
+			return nil, fmt.Errorf("cannot decrypt key %s: %s", key.Title, err)
+		}
+		return privateKey, nil
+	}
+	privateKey, err := ssh.ParseRawPrivateKey([]byte(key.Key))
+	if _, ok := err.(*ssh.PassphraseMissingError); ok {
+		return nil, fmt.Errorf("key %s is encrypted and has no passphrase", key.Title)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse key %s: %s", key.Title, err)
+	}
+	return privateKey, nil
+}
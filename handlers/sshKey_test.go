@@ -0,0 +1,37 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"github.com/deploji/deploji-server/models"
+	"strings"
+	"testing"
+)
+
+func encryptTestKey(t *testing.T, key *models.SshKey, passphrase string) *models.SshKey {
+	block, _ := pem.Decode([]byte(key.Key))
+	encrypted, err := x509.EncryptPEMBlock(rand.Reader, block.Type, block.Bytes, []byte(passphrase), x509.PEMCipherAES256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &models.SshKey{Title: key.Title, Key: models.Key(pem.EncodeToMemory(encrypted))}
+}
+
+func TestParsePrivateKey(t *testing.T) {
+	key := newTestKey(t, "deploy")
+	if _, err := parsePrivateKey(key, ""); err != nil {
+		t.Errorf("unexpected error parsing key: %s", err)
+	}
+
+	encrypted := encryptTestKey(t, key, "secret")
+	if _, err := parsePrivateKey(encrypted, "secret"); err != nil {
+		t.Errorf("unexpected error decrypting key: %s", err)
+	}
+	if _, err := parsePrivateKey(encrypted, ""); err == nil || !strings.Contains(err.Error(), "has no passphrase") {
+		t.Errorf("expected missing passphrase error, got %v", err)
+	}
+	if _, err := parsePrivateKey(encrypted, "wrong"); err == nil {
+		t.Error("expected error decrypting key with wrong passphrase")
+	}
+}
@@ -0,0 +1,108 @@
+package handlers
+
+import (
+	"github.com/deploji/deploji-server/dto"
+	"github.com/deploji/deploji-server/models"
+	"github.com/deploji/deploji-worker/ansibleService"
+	"github.com/deploji/deploji-worker/workerService"
+	"time"
+)
+
+// StatusSchemaVersion is the version of StatusMessage. It is increased when fields are removed or change
+// their meaning, consumers should ignore fields they do not know. Version 1 is the plain dto.StatusMessage.
+const StatusSchemaVersion = 2
+
+// StatusMessage is the job status message extended with details of the run.
+// Fields which are not known yet, e.g. the exit code of a job which is still processing, are omitted.
+type StatusMessage struct {
+	dto.StatusMessage
+	SchemaVersion int
+	// Timestamp is the time the status was published.
+	Timestamp   time.Time
+	WorkerID    string
+	Attempt     int        `json:",omitempty"`
+	MaxAttempts int        `json:",omitempty"`
+	StartedAt   *time.Time `json:",omitempty"`
+	FinishedAt  *time.Time `json:",omitempty"`
+	// Duration of the job in seconds, it is set once the job is finished.
+	Duration      float64      `json:",omitempty"`
+	ExitCode      *int         `json:",omitempty"`
+	FailureReason FailureClass `json:",omitempty"`
+	Commit        string       `json:",omitempty"`
+	Hosts         *HostSummary `json:",omitempty"`
+	// Preview is set for check mode runs, which do not apply changes.
+	Preview bool `json:",omitempty"`
+}
+
+// HostSummary counts hosts of the playbook stats having at least one task with given result.
+type HostSummary struct {
+	Hosts       int
+	Ok          int
+	Changed     int
+	Unreachable int
+	Failed      int
+	Skipped     int
+	Rescued     int
+	Ignored     int
+}
+
+func newHostSummary(hosts []ansibleService.HostResult) *HostSummary {
+	summary := &HostSummary{Hosts: len(hosts)}
+	count := func(counter *int, tasks int) {
+		if tasks > 0 {
+			*counter++
+		}
+	}
+	for _, host := range hosts {
+		count(&summary.Ok, host.Ok)
+		count(&summary.Changed, host.Changed)
+		count(&summary.Unreachable, host.Unreachable)
+		count(&summary.Failed, host.Failed)
+		count(&summary.Skipped, host.Skipped)
+		count(&summary.Rescued, host.Rescued)
+		count(&summary.Ignored, host.Ignored)
+	}
+	return summary
+}
+
+func newStatusMessage(job *models.Job) StatusMessage {
+	message := StatusMessage{
+		StatusMessage: dto.StatusMessage{
+			Type:   job.Type,
+			ID:     job.ID,
+			Status: job.Status,
+		},
+		SchemaVersion: StatusSchemaVersion,
+		Timestamp:     time.Now(),
+		WorkerID:      workerService.Info().ID,
+	}
+	state := getRun(job.ID)
+	if state == nil {
+		return message
+	}
+	message.Attempt = state.Attempt
+	message.MaxAttempts = state.MaxAttempts
+	startedAt, finishedAt := state.StartedAt, state.FinishedAt
+	if !startedAt.IsZero() {
+		message.StartedAt = &startedAt
+	}
+	if !finishedAt.IsZero() {
+		message.FinishedAt = &finishedAt
+		if message.StartedAt != nil {
+			message.Duration = finishedAt.Sub(startedAt).Seconds()
+		}
+	}
+	message.ExitCode = state.ExitCode
+	if !successful(job.Status) {
+		message.FailureReason = state.Failure
+	}
+	message.Commit = state.Commit
+	message.Hosts = state.Hosts
+	message.Preview = state.Preview
+	return message
+}
+
+// publishStatus publishes the current status of the job.
+func publishStatus(job *models.Job) {
+	broker.PublishStatus(dto.MarshallMessage(newStatusMessage(job)))
+}
@@ -0,0 +1,55 @@
+package handlers
+
+import (
+	"github.com/deploji/deploji-server/models"
+	"github.com/deploji/deploji-worker/ansibleService"
+	"testing"
+	"time"
+)
+
+func TestNewStatusMessage(t *testing.T) {
+	job := &models.Job{Type: models.TypeDeployment, Status: models.StatusFailed}
+	job.ID = 42
+	startRunning(job.ID)
+	defer stopRunning(job.ID)
+
+	exitCode := ansibleExitUnreachable
+	state := getRun(job.ID)
+	state.StartedAt = time.Date(2020, 10, 1, 12, 0, 0, 0, time.UTC)
+	state.FinishedAt = state.StartedAt.Add(90 * time.Second)
+	state.ExitCode = &exitCode
+	state.Failure = FailureUnreachable
+	state.Commit = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4"
+
+	message := newStatusMessage(job)
+	if message.SchemaVersion != StatusSchemaVersion {
+		t.Errorf("expected schema version %d, got %d", StatusSchemaVersion, message.SchemaVersion)
+	}
+	if message.ID != job.ID || message.Status != models.StatusFailed {
+		t.Errorf("unexpected job %d with status %d", message.ID, message.Status)
+	}
+	if message.Duration != 90 {
+		t.Errorf("expected duration 90, got %f", message.Duration)
+	}
+	if message.ExitCode == nil || *message.ExitCode != exitCode {
+		t.Errorf("expected exit code %d, got %v", exitCode, message.ExitCode)
+	}
+	if message.FailureReason != FailureUnreachable {
+		t.Errorf("expected failure reason %s, got %s", FailureUnreachable, message.FailureReason)
+	}
+	if message.Commit != state.Commit {
+		t.Errorf("expected commit %s, got %s", state.Commit, message.Commit)
+	}
+}
+
+func TestNewHostSummary(t *testing.T) {
+	summary := newHostSummary([]ansibleService.HostResult{
+		{Host: "web1", Ok: 3, Changed: 1},
+		{Host: "web2", Ok: 2, Failed: 1},
+		{Host: "db1", Unreachable: 1},
+	})
+	expected := HostSummary{Hosts: 3, Ok: 2, Changed: 1, Failed: 1, Unreachable: 1}
+	if *summary != expected {
+		t.Errorf("expected %+v, got %+v", expected, *summary)
+	}
+}
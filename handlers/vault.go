@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"fmt"
+	"github.com/deploji/deploji-server/models"
+	"github.com/deploji/deploji-worker/utils"
+	"regexp"
+)
+
+// VaultID is a vault credential of a job together with the vault ID label of secrets it decrypts.
+type VaultID struct {
+	Label string
+	KeyID uint
+}
+
+var vaultLabelPattern = regexp.MustCompile(`^[\w.\-]+$`)
+
+// validateVaultIDs checks labels can be passed to --vault-id. Labels have to be unique,
+// ansible-playbook would otherwise pick a password by the order of arguments.
+func validateVaultIDs(vaultIDs []VaultID) error {
+	labels := make(map[string]bool)
+	for _, vaultID := range vaultIDs {
+		if !vaultLabelPattern.MatchString(vaultID.Label) {
+			return fmt.Errorf("invalid vault ID label: %q", vaultID.Label)
+		}
+		if labels[vaultID.Label] {
+			return fmt.Errorf("duplicate vault ID label: %q", vaultID.Label)
+		}
+		labels[vaultID.Label] = true
+	}
+	return nil
+}
+
+// vaultIDFile is a vault password file of a job, Label is empty for the vault key of the job.
+type vaultIDFile struct {
+	Label string
+	Path  string
+}
+
+// arg returns the --vault-id value of the file.
+func (f vaultIDFile) arg() string {
+	if f.Label == "" {
+		return f.Path
+	}
+	return fmt.Sprintf("%s@%s", f.Label, f.Path)
+}
+
+// writeVaultKeys writes the vault key of the job and its labeled vault credentials to the secrets directory.
+func writeVaultKeys(job *models.Job, vaultIDs []VaultID, secrets *utils.Secrets) ([]vaultIDFile, error) {
+	var files []vaultIDFile
+	if job.VaultKeyID != 0 {
+		path, err := secrets.Write("vault-key", string(job.VaultKey.Key))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, vaultIDFile{Path: path})
+	}
+	for _, vaultID := range vaultIDs {
+		key := models.GetSshKey(vaultID.KeyID)
+		if key == nil {
+			return nil, fmt.Errorf("vault key %d of %s not found", vaultID.KeyID, vaultID.Label)
+		}
+		path, err := secrets.Write(fmt.Sprintf("vault-key-%s", vaultID.Label), string(key.Key))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, vaultIDFile{Label: vaultID.Label, Path: path})
+	}
+	return files, nil
+}
@@ -0,0 +1,32 @@
+package handlers
+
+import (
+	"testing"
+)
+
+func TestValidateVaultIDs(t *testing.T) {
+	valid := []VaultID{{Label: "prod", KeyID: 3}, {Label: "shared", KeyID: 4}}
+	if err := validateVaultIDs(valid); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	invalid := [][]VaultID{
+		{{Label: "", KeyID: 3}},
+		{{Label: "prod@/etc/passwd", KeyID: 3}},
+		{{Label: "prod/shared", KeyID: 3}},
+		{{Label: "prod", KeyID: 3}, {Label: "prod", KeyID: 4}},
+	}
+	for _, vaultIDs := range invalid {
+		if err := validateVaultIDs(vaultIDs); err == nil {
+			t.Errorf("expected %v to be invalid", vaultIDs)
+		}
+	}
+}
+
+func TestVaultIDFileArg(t *testing.T) {
+	if arg := (vaultIDFile{Path: "/secrets/vault-key"}).arg(); arg != "/secrets/vault-key" {
+		t.Errorf("unexpected arg %s", arg)
+	}
+	if arg := (vaultIDFile{Label: "prod", Path: "/secrets/vault-key-prod"}).arg(); arg != "prod@/secrets/vault-key-prod" {
+		t.Errorf("unexpected arg %s", arg)
+	}
+}
@@ -0,0 +1,139 @@
+package handlers
+
+import (
+	"fmt"
+	"github.com/deploji/deploji-server/dto"
+	"github.com/deploji/deploji-server/models"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// workspacesDir is the directory of job workspaces. Workspaces are at the same depth as repositories,
+// so paths relative to the working directory of a playbook keep pointing at the same files.
+const workspacesDir = "storage/workspaces"
+
+// WorkspaceRetention defines which workspaces are kept after jobs finish.
+type WorkspaceRetention string
+
+const (
+	RetainNone   WorkspaceRetention = "none"
+	RetainFailed WorkspaceRetention = "failed"
+	RetainAll    WorkspaceRetention = "all"
+)
+
+// workspaceRetention returns the retention configured by WORKSPACE_RETENTION, by default workspaces are removed.
+func workspaceRetention() WorkspaceRetention {
+	switch retention := WorkspaceRetention(os.Getenv("WORKSPACE_RETENTION")); retention {
+	case RetainFailed, RetainAll:
+		return retention
+	default:
+		return RetainNone
+	}
+}
+
+func workspaceDir(jobID uint) string {
+	return filepath.Join(workspacesDir, fmt.Sprintf("%d", jobID))
+}
+
+// createWorkspace exports the tree of the commit from the project repository into the workspace of the job,
+// replacing a workspace left by a previous attempt. Jobs running concurrently on the same project get their own
+// files, which are not reset under them by synchronization of the repository.
+func createWorkspace(job *models.Job, commit string, jobLogs chan dto.Message) (string, error) {
+	dir, err := filepath.Abs(workspaceDir(job.ID))
+	if err != nil {
+		return "", err
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return "", err
+	}
+	saveJobLog(jobLogs, job, fmt.Sprintf("Creating workspace at %s", commit))
+
+	projectID := jobProjectID(job)
+	defer lockProject(projectID)()
+	repo, err := git.PlainOpen(fmt.Sprintf("./storage/repositories/%d", projectID))
+	if err != nil {
+		return "", err
+	}
+	if err := exportCommit(repo, commit, dir); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return dir, nil
+}
+
+// exportCommit writes files of the commit to dir.
+func exportCommit(repo *git.Repository, commit string, dir string) error {
+	commitObject, err := repo.CommitObject(plumbing.NewHash(commit))
+	if err != nil {
+		return err
+	}
+	tree, err := commitObject.Tree()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return tree.Files().ForEach(func(file *object.File) error {
+		return exportFile(dir, file)
+	})
+}
+
+func exportFile(dir string, file *object.File) error {
+	path := filepath.Join(dir, filepath.FromSlash(file.Name))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if file.Mode == filemode.Symlink {
+		target, err := file.Contents()
+		if err != nil {
+			return err
+		}
+		return os.Symlink(target, path)
+	}
+	mode := os.FileMode(0644)
+	if file.Mode == filemode.Executable {
+		mode = 0755
+	}
+	reader, err := file.Reader()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	output, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(output, reader); err != nil {
+		output.Close()
+		return err
+	}
+	return output.Close()
+}
+
+// cleanupWorkspace removes the workspace of the finished job unless it is retained.
+func cleanupWorkspace(job *models.Job, jobLogs chan dto.Message) {
+	dir := workspaceDir(job.ID)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return
+	}
+	switch workspaceRetention() {
+	case RetainAll:
+		saveJobLog(jobLogs, job, fmt.Sprintf("Workspace retained at %s", dir))
+		return
+	case RetainFailed:
+		if !successful(job.Status) {
+			saveJobLog(jobLogs, job, fmt.Sprintf("Workspace of failed job retained at %s", dir))
+			return
+		}
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		log.Printf("Cannot remove workspace %s: %s", dir, err)
+	}
+}
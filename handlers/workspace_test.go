@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestExportCommit(t *testing.T) {
+	repoDir, err := ioutil.TempDir("", "repository")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(repoDir)
+	repo, err := git.PlainInit(repoDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.MkdirAll(filepath.Join(repoDir, "roles", "web"), 0755)
+	ioutil.WriteFile(filepath.Join(repoDir, "site.yml"), []byte("- hosts: all\n"), 0644)
+	ioutil.WriteFile(filepath.Join(repoDir, "roles", "web", "check.sh"), []byte("#!/bin/sh\n"), 0755)
+	os.Symlink("site.yml", filepath.Join(repoDir, "main.yml"))
+	tree, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.AddGlob("."); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := tree.Commit("Initial commit", &git.CommitOptions{Author: &object.Signature{Name: "test", When: time.Now()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Changes of the repository after the commit are not exported.
+	ioutil.WriteFile(filepath.Join(repoDir, "site.yml"), []byte("- hosts: web\n"), 0644)
+
+	workspace, err := ioutil.TempDir("", "workspace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workspace)
+	if err := exportCommit(repo, hash.String(), workspace); err != nil {
+		t.Fatal(err)
+	}
+
+	if content, _ := ioutil.ReadFile(filepath.Join(workspace, "site.yml")); string(content) != "- hosts: all\n" {
+		t.Errorf("unexpected site.yml content: %q", content)
+	}
+	if info, err := os.Stat(filepath.Join(workspace, "roles", "web", "check.sh")); err != nil || info.Mode().Perm()&0100 == 0 {
+		t.Errorf("expected executable check.sh, got %v, %v", info, err)
+	}
+	if target, err := os.Readlink(filepath.Join(workspace, "main.yml")); err != nil || target != "site.yml" {
+		t.Errorf("expected symlink to site.yml, got %q, %v", target, err)
+	}
+	if _, err := os.Stat(filepath.Join(workspace, ".git")); !os.IsNotExist(err) {
+		t.Error("workspace should not contain the git directory")
+	}
+}
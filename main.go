@@ -2,37 +2,158 @@ package main
 
 import (
 	"fmt"
+	"github.com/deploji/deploji-server/dto"
 	"github.com/deploji/deploji-server/models"
 	"github.com/deploji/deploji-worker/amqpService"
+	"github.com/deploji/deploji-worker/brokerService"
 	"github.com/deploji/deploji-worker/handlers"
+	"github.com/deploji/deploji-worker/utils"
+	"github.com/deploji/deploji-worker/workerModels"
+	"github.com/deploji/deploji-worker/workerService"
 	"github.com/joho/godotenv"
 	"golang.org/x/net/context"
+	"log"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
+// flushTimeout limits the time spent publishing pending job statuses, logs and dead letters on shutdown.
+const flushTimeout = 30 * time.Second
+
+// pendingJobsPollInterval is the interval of looking up pending jobs when running with the memory broker.
+const pendingJobsPollInterval = 5 * time.Second
+
 func main() {
 	e := godotenv.Load()
 	if e != nil {
 		fmt.Print(e)
 	}
 	models.InitDatabase()
+	workerModels.Migrate()
+	utils.RemoveLegacyKeys()
+	utils.RemoveStaleSecrets()
 	ctx, done := context.WithCancel(context.Background())
+	consumerCtx, stopConsuming := context.WithCancel(ctx)
+	pool := workerService.NewPool(utils.GetEnvInt("WORKER_SLOTS", 1))
+	gracePeriod := time.Duration(utils.GetEnvInt("SHUTDOWN_GRACE_PERIOD", 60)) * time.Second
+	broker := newBroker(ctx)
+	handlers.SetBroker(broker)
 
+	jobs := make(chan *brokerService.Delivery)
+	subscribed := make(chan struct{})
 	go func() {
-		amqpService.Subscribe(amqpService.Redial(ctx, os.Getenv("AMQP_URL")), amqpService.Jobs, "jobs")
-		done()
+		broker.SubscribeJobs(consumerCtx, workerService.Info().Queues(), pool.Size(), jobs)
+		close(jobs)
+		close(subscribed)
 	}()
 
+	controls := make(chan dto.Message)
+	go broker.SubscribeControl(ctx, controls)
+
 	go func() {
-		amqpService.Publish(amqpService.Redial(ctx, os.Getenv("AMQP_URL")), amqpService.JobStatuses, "job_statuses")
-		done()
+		for message := range controls {
+			handlers.ProcessControlMessage(message, pool)
+		}
 	}()
 
+	pool.Run(jobs, handlers.ProcessJobMessage)
+	log.Printf("worker %s started", workerService.Info())
+
+	heartbeatCtx, stopHeartbeats := context.WithCancel(ctx)
+	heartbeatsStopped := make(chan struct{})
 	go func() {
-		for job := range amqpService.Jobs {
-			handlers.ProcessJobMessage(&job)
-		}
+		workerService.SendHeartbeats(heartbeatCtx, broker, pool, workerService.HeartbeatInterval())
+		close(heartbeatsStopped)
 	}()
 
-	<-ctx.Done()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	select {
+	case sig := <-signals:
+		log.Printf("received %s, shutting down", sig)
+	case <-subscribed:
+		log.Println("job subscriptions closed, shutting down")
+	}
+
+	stopConsuming()
+	<-subscribed
+	pool.Shutdown(gracePeriod)
+	stopHeartbeats()
+	<-heartbeatsStopped
+	broker.Close(flushTimeout)
+	done()
+}
+
+// newBroker returns the broker selected by the BROKER variable: "amqp" (default) or "memory" for single node runs.
+func newBroker(ctx context.Context) brokerService.Broker {
+	switch os.Getenv("BROKER") {
+	case "memory":
+		broker := brokerService.NewMemoryBroker()
+		go pollPendingJobs(ctx, broker, workerService.JobQueue)
+		return broker
+	default:
+		broker := amqpService.NewBroker(os.Getenv("AMQP_URL"))
+		go deleteLegacyJobLogExchanges(broker)
+		return broker
+	}
+}
+
+// legacyJobLogExchangesMigration names the removal of per job log exchanges declared by previous versions of the worker.
+const legacyJobLogExchangesMigration = "delete_legacy_job_log_exchanges"
+
+// deleteLegacyJobLogExchanges removes per job log exchanges once, the removal is skipped after it completed.
+func deleteLegacyJobLogExchanges(broker *amqpService.Broker) {
+	if workerModels.IsMigrated(legacyJobLogExchangesMigration) {
+		return
+	}
+	names, err := handlers.LegacyJobLogExchanges()
+	if err != nil {
+		log.Printf("Cannot get jobs of legacy job log exchanges: %s", err)
+		return
+	}
+	if err := broker.DeleteUnusedExchanges(names); err != nil {
+		log.Printf("Cannot delete legacy job log exchanges: %s", err)
+		return
+	}
+	workerModels.SaveMigration(legacyJobLogExchangesMigration)
+}
+
+// enqueuePendingJobs enqueues pending jobs which were not enqueued yet. Jobs which left pending are forgotten,
+// so they are enqueued again if they are set back to pending.
+func enqueuePendingJobs(broker *brokerService.MemoryBroker, queueName string, jobs []*models.Job, enqueued map[uint]bool) {
+	pending := make(map[uint]bool, len(jobs))
+	for _, job := range jobs {
+		pending[job.ID] = true
+		if !enqueued[job.ID] {
+			enqueued[job.ID] = true
+			broker.Enqueue(queueName, dto.MarshallMessage(dto.JobMessage{Type: job.Type, ID: job.ID}))
+		}
+	}
+	for id := range enqueued {
+		if !pending[id] {
+			delete(enqueued, id)
+		}
+	}
+}
+
+// pollPendingJobs enqueues jobs waiting in the database, it replaces the job queue in single node runs.
+func pollPendingJobs(ctx context.Context, broker *brokerService.MemoryBroker, queueName string) {
+	enqueued := make(map[uint]bool)
+	ticker := time.NewTicker(pendingJobsPollInterval)
+	defer ticker.Stop()
+	for {
+		var jobs []*models.Job
+		if err := models.GetDB().Where("status = ?", models.StatusPending).Order("id").Find(&jobs).Error; err != nil {
+			log.Printf("Cannot get pending jobs: %s", err)
+		} else {
+			enqueuePendingJobs(broker, queueName, jobs, enqueued)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
 }
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"github.com/deploji/deploji-server/models"
 	"github.com/deploji/deploji-worker/utils"
+	"github.com/deploji/deploji-worker/workerModels"
 	"text/template"
 	"time"
 )
@@ -14,6 +15,8 @@ const (
 	NotificationTypeStart   NotificationType = "start"
 	NotificationTypeSuccess NotificationType = "success"
 	NotificationTypeFail    NotificationType = "fail"
+	NotificationTypeCancel  NotificationType = "cancel"
+	NotificationTypeTimeout NotificationType = "timeout"
 )
 
 type NotificationEmailTemplate struct {
@@ -27,6 +30,9 @@ type NotificationEmailTemplate struct {
 	JobID       string
 	JobStart    time.Time
 	JobLogs     []*models.JobLog
+	Hosts       []*workerModels.JobHostResult
+	Preview     bool
+	Options     string
 }
 
 func (t NotificationEmailTemplate) Html() string {
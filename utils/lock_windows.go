@@ -0,0 +1,17 @@
+//go:build windows
+// +build windows
+
+package utils
+
+import (
+	"os"
+)
+
+// lockFile creates the file and keeps it open, the lock is held until the file is closed.
+// Open files cannot be removed, so it fails when another process holds the lock.
+func lockFile(path string) (*os.File, error) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+}
@@ -0,0 +1,160 @@
+package utils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// secretsPrefix names directories of secrets created by the worker.
+const secretsPrefix = "deploji-secrets-"
+
+// secretsLock is the file locked by the worker using a secrets directory.
+const secretsLock = ".lock"
+
+// secretsLockGrace is the time a worker has to lock a secrets directory it created.
+const secretsLockGrace = time.Minute
+
+// legacyKeysDir is the directory previous versions of the worker kept keys in.
+const legacyKeysDir = "storage/keys"
+
+// SecretsRoot returns the directory secrets are kept in. It is SECRETS_DIR, by default /dev/shm when it exists,
+// so secrets are kept in memory and never written to the worker volume.
+func SecretsRoot() string {
+	if dir := os.Getenv("SECRETS_DIR"); dir != "" {
+		return dir
+	}
+	if info, err := os.Stat("/dev/shm"); err == nil && info.IsDir() {
+		return "/dev/shm"
+	}
+	return os.TempDir()
+}
+
+// Secrets is a private directory of secrets of a single job. It is readable only by the worker user
+// and has to be removed with Remove once the job ends.
+type Secrets struct {
+	Dir  string
+	lock *os.File
+}
+
+// NewSecrets creates a secrets directory, name is a part of the directory name. The directory is locked while
+// the secrets are in use, so directories left by killed workers can be told apart, see RemoveStaleSecrets.
+func NewSecrets(name string) (*Secrets, error) {
+	dir, err := ioutil.TempDir(SecretsRoot(), fmt.Sprintf("%s%s-", secretsPrefix, name))
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(dir, 0700); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	lock, err := lockFile(filepath.Join(dir, secretsLock))
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return &Secrets{Dir: dir, lock: lock}, nil
+}
+
+// Write stores the secret in a file with 0600 permissions and returns its absolute path.
+func (s *Secrets) Write(name string, content string) (string, error) {
+	path := filepath.Join(s.Dir, name)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	if _, err := file.WriteString(content); err != nil {
+		file.Close()
+		return "", err
+	}
+	return path, file.Close()
+}
+
+// Remove overwrites secrets with zeros and removes the directory.
+func (s *Secrets) Remove() error {
+	s.lock.Close()
+	return removeSecrets(s.Dir)
+}
+
+func removeSecrets(dir string) error {
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return nil
+		}
+		return shred(path, info.Size())
+	})
+	if err != nil {
+		log.Printf("Error overwriting secrets in %s: %s", dir, err)
+	}
+	return os.RemoveAll(dir)
+}
+
+func shred(path string, size int64) error {
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := file.Write(make([]byte, size)); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// RemoveStaleSecrets removes secrets directories left by workers which were killed before removing them.
+// Directories of other worker processes sharing the secrets root, possibly in other containers, are kept
+// while the processes hold their locks.
+func RemoveStaleSecrets() {
+	root := SecretsRoot()
+	entries, err := ioutil.ReadDir(root)
+	if err != nil {
+		log.Printf("Cannot list secrets in %s: %s", root, err)
+		return
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), secretsPrefix) || !staleSecrets(filepath.Join(root, entry.Name())) {
+			continue
+		}
+		dir := filepath.Join(root, entry.Name())
+		log.Printf("Removing stale secrets %s", dir)
+		if err := removeSecrets(dir); err != nil {
+			log.Printf("Error removing secrets: %s", err)
+		}
+	}
+}
+
+// staleSecrets reports whether the secrets directory is not locked by a running worker. Directories without
+// the lock were left by previous versions of the worker, unless they were created right now and are not locked yet.
+func staleSecrets(dir string) bool {
+	path := filepath.Join(dir, secretsLock)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		info, err := os.Stat(dir)
+		return err != nil || time.Since(info.ModTime()) > secretsLockGrace
+	}
+	lock, err := lockFile(path)
+	if err != nil {
+		return false
+	}
+	lock.Close()
+	return true
+}
+
+// RemoveLegacyKeys removes keys written to the worker volume by previous versions of the worker.
+func RemoveLegacyKeys() {
+	if _, err := os.Stat(legacyKeysDir); os.IsNotExist(err) {
+		return
+	}
+	log.Printf("Removing keys stored in %s", legacyKeysDir)
+	if err := removeSecrets(legacyKeysDir); err != nil {
+		log.Printf("Error removing keys: %s", err)
+	}
+}
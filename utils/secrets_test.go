@@ -0,0 +1,95 @@
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSecrets(t *testing.T) {
+	root, err := ioutil.TempDir("", "secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	os.Setenv("SECRETS_DIR", root)
+	defer os.Unsetenv("SECRETS_DIR")
+
+	secrets, err := NewSecrets("job-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(secrets.Dir); err != nil || info.Mode().Perm() != 0700 {
+		t.Errorf("expected private secrets directory, got %v, %v", info, err)
+	}
+	path, err := secrets.Write("ssh-key", "private key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !filepath.IsAbs(path) || filepath.Dir(path) != secrets.Dir {
+		t.Errorf("unexpected key path %s", path)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("expected key readable only by the owner, got %v, %v", info, err)
+	}
+	if _, err := secrets.Write("ssh-key", "other key"); err == nil {
+		t.Error("expected existing secret not to be overwritten")
+	}
+
+	if err := secrets.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(secrets.Dir); !os.IsNotExist(err) {
+		t.Errorf("expected secrets directory to be removed, got %v", err)
+	}
+}
+
+func TestRemoveStaleSecrets(t *testing.T) {
+	root, err := ioutil.TempDir("", "secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	os.Setenv("SECRETS_DIR", root)
+	defer os.Unsetenv("SECRETS_DIR")
+
+	locked, err := NewSecrets("job-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer locked.Remove()
+
+	dirs := map[string]bool{
+		filepath.Base(locked.Dir):       true,
+		secretsPrefix + "job-2-456":     false,
+		secretsPrefix + "123-job-3-789": false,
+		secretsPrefix + "job-4-012":     true,
+		"other":                         true,
+	}
+	for dir := range dirs {
+		if dir == filepath.Base(locked.Dir) {
+			continue
+		}
+		if err := os.Mkdir(filepath.Join(root, dir), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// unlocked directory of a killed worker
+	if err := ioutil.WriteFile(filepath.Join(root, secretsPrefix+"job-2-456", secretsLock), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	// directory of a previous version, job-4 is being created and not locked yet
+	old := time.Now().Add(-2 * secretsLockGrace)
+	if err := os.Chtimes(filepath.Join(root, secretsPrefix+"123-job-3-789"), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	RemoveStaleSecrets()
+	for dir, kept := range dirs {
+		if _, err := os.Stat(filepath.Join(root, dir)); (err == nil) != kept {
+			t.Errorf("expected %s to be kept: %v, got %v", dir, kept, err)
+		}
+	}
+}
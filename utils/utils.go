@@ -1,11 +1,10 @@
 package utils
 
 import (
-	"fmt"
 	"github.com/deploji/deploji-server/dto"
-	"io/ioutil"
 	"log"
 	"os"
+	"strconv"
 	"strings"
 )
 
@@ -15,17 +14,17 @@ func HandleError(err error, message string) {
 	}
 }
 
-func WriteKey(id uint, content string) error {
-	if err := os.MkdirAll("storage/keys", 0700); err != nil {
-		log.Printf("Error creating directory: %s", err)
-		return err
+func GetEnvInt(key string, fallback int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
 	}
-	if err := ioutil.WriteFile(fmt.Sprintf("storage/keys/%d", id), []byte(content), 0600); err != nil {
-		log.Printf("Error saving key file: %s", err)
-		return err
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Invalid value of %s: %s, using default: %d", key, value, fallback)
+		return fallback
 	}
-	os.Chmod(fmt.Sprintf("storage/keys/%d", id), 0600)
-	return nil
+	return i
 }
 
 type chanWriter struct {
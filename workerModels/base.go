@@ -0,0 +1,17 @@
+package workerModels
+
+import (
+	"github.com/deploji/deploji-server/models"
+)
+
+// Migrate creates tables of data recorded by the worker. It uses the database initialized by models.InitDatabase.
+func Migrate() {
+	models.GetDB().AutoMigrate(
+		&JobEvent{},
+		&JobHostResult{},
+		&JobDiff{},
+		&SshKeyPassphrase{},
+		&WorkerHeartbeat{},
+		&WorkerMigration{},
+	)
+}
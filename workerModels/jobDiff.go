@@ -0,0 +1,36 @@
+package workerModels
+
+import (
+	"github.com/deploji/deploji-server/models"
+	"github.com/jinzhu/gorm"
+	"log"
+)
+
+// JobDiff is a diff reported by a task of a job run with --diff.
+type JobDiff struct {
+	gorm.Model   `json:"-"`
+	JobID        uint   `gorm:"index:job_diff_job"`
+	Task         string `gorm:"type:text"`
+	Host         string
+	BeforeHeader string `gorm:"type:text"`
+	AfterHeader  string `gorm:"type:text"`
+	Before       string `gorm:"type:text"`
+	After        string `gorm:"type:text"`
+	Prepared     string `gorm:"type:text"`
+}
+
+func GetJobDiffs(jobID uint) []*JobDiff {
+	var diffs []*JobDiff
+	err := models.GetDB().Where("job_id = ?", jobID).Order("id").Find(&diffs).Error
+	if err != nil {
+		return nil
+	}
+	return diffs
+}
+
+func SaveJobDiff(diff *JobDiff) {
+	err := models.GetDB().Create(diff).Error
+	if err != nil {
+		log.Printf("Error saving job diff: %s", err)
+	}
+}
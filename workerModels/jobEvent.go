@@ -0,0 +1,38 @@
+package workerModels
+
+import (
+	"github.com/deploji/deploji-server/models"
+	"github.com/jinzhu/gorm"
+	"log"
+	"time"
+)
+
+// JobEvent is a structured Ansible event of a job.
+type JobEvent struct {
+	gorm.Model `json:"-"`
+	JobID      uint `gorm:"index:job_event_job"`
+	Event      string
+	Timestamp  time.Time
+	Play       string `gorm:"type:text"`
+	Task       string `gorm:"type:text"`
+	Host       string
+	Changed    bool
+	// Data is the whole event encoded as JSON.
+	Data string `gorm:"type:text"`
+}
+
+func GetJobEvents(jobID uint) []*JobEvent {
+	var events []*JobEvent
+	err := models.GetDB().Where("job_id = ?", jobID).Order("id").Find(&events).Error
+	if err != nil {
+		return nil
+	}
+	return events
+}
+
+func SaveJobEvent(event *JobEvent) {
+	err := models.GetDB().Create(event).Error
+	if err != nil {
+		log.Printf("Error saving job event: %s", err)
+	}
+}
@@ -0,0 +1,51 @@
+package workerModels
+
+import (
+	"github.com/deploji/deploji-server/models"
+	"github.com/jinzhu/gorm"
+	"log"
+)
+
+// JobHostResult counts tasks of a host of a job by their result, as summarized by the playbook stats.
+type JobHostResult struct {
+	gorm.Model  `json:"-"`
+	JobID       uint `gorm:"index:job_host_result_job"`
+	Host        string
+	Ok          int
+	Changed     int
+	Unreachable int
+	Failed      int
+	Skipped     int
+	Rescued     int
+	Ignored     int
+}
+
+func GetJobHostResults(jobID uint) []*JobHostResult {
+	var results []*JobHostResult
+	err := models.GetDB().Where("job_id = ?", jobID).Order("id").Find(&results).Error
+	if err != nil {
+		return nil
+	}
+	return results
+}
+
+// SaveJobHostResults replaces host results of the job, e.g. those recorded by a previous attempt.
+func SaveJobHostResults(jobID uint, results []*JobHostResult) {
+	tx := models.GetDB().Begin()
+	if err := tx.Unscoped().Where("job_id = ?", jobID).Delete(&JobHostResult{}).Error; err != nil {
+		tx.Rollback()
+		log.Printf("Error deleting job host results: %s", err)
+		return
+	}
+	for _, result := range results {
+		result.JobID = jobID
+		if err := tx.Create(result).Error; err != nil {
+			tx.Rollback()
+			log.Printf("Error saving job host result: %s", err)
+			return
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		log.Printf("Error saving job host results: %s", err)
+	}
+}
@@ -0,0 +1,26 @@
+package workerModels
+
+import (
+	"github.com/deploji/deploji-server/models"
+	"github.com/jinzhu/gorm"
+)
+
+// SshKeyPassphrase is the passphrase of an encrypted SSH key, keys without a passphrase have no row.
+type SshKeyPassphrase struct {
+	gorm.Model `json:"-"`
+	SshKeyID   uint   `gorm:"unique_index:ssh_key_passphrase_key"`
+	Passphrase string `json:"-"`
+}
+
+// GetSshKeyPassphrase returns the passphrase of the key, it is empty when the key is not encrypted.
+func GetSshKeyPassphrase(keyID uint) (string, error) {
+	var passphrase SshKeyPassphrase
+	err := models.GetDB().Where("ssh_key_id = ?", keyID).First(&passphrase).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return passphrase.Passphrase, nil
+}
@@ -0,0 +1,52 @@
+package workerModels
+
+import (
+	"fmt"
+	"github.com/deploji/deploji-server/models"
+	"log"
+	"strings"
+	"time"
+)
+
+// WorkerHeartbeat is the last heartbeat of a worker. Workers receiving a redelivered job use it to tell
+// whether the job is still run by another live worker.
+type WorkerHeartbeat struct {
+	WorkerID  string `gorm:"primary_key"`
+	Timestamp time.Time
+	Goodbye   bool
+	// JobIDs is a comma separated list of jobs run by the worker.
+	JobIDs string `gorm:"type:text"`
+}
+
+// NewWorkerHeartbeat returns the heartbeat of a worker running given jobs.
+func NewWorkerHeartbeat(workerID string, timestamp time.Time, goodbye bool, jobIDs []uint) *WorkerHeartbeat {
+	ids := make([]string, len(jobIDs))
+	for i, id := range jobIDs {
+		ids[i] = fmt.Sprintf("%d", id)
+	}
+	return &WorkerHeartbeat{WorkerID: workerID, Timestamp: timestamp, Goodbye: goodbye, JobIDs: strings.Join(ids, ",")}
+}
+
+// Runs reports whether the worker was running the job when it sent the heartbeat.
+func (h *WorkerHeartbeat) Runs(jobID uint) bool {
+	id := fmt.Sprintf("%d", jobID)
+	for _, runningID := range strings.Split(h.JobIDs, ",") {
+		if runningID == id {
+			return true
+		}
+	}
+	return false
+}
+
+func SaveWorkerHeartbeat(heartbeat *WorkerHeartbeat) {
+	if err := models.GetDB().Save(heartbeat).Error; err != nil {
+		log.Printf("Error saving worker heartbeat: %s", err)
+	}
+}
+
+// GetWorkerHeartbeats returns heartbeats of workers which were alive after since.
+func GetWorkerHeartbeats(since time.Time) ([]*WorkerHeartbeat, error) {
+	var heartbeats []*WorkerHeartbeat
+	err := models.GetDB().Where("timestamp > ? AND goodbye = ?", since, false).Find(&heartbeats).Error
+	return heartbeats, err
+}
@@ -0,0 +1,29 @@
+package workerModels
+
+import (
+	"github.com/deploji/deploji-server/models"
+	"log"
+	"time"
+)
+
+// WorkerMigration records a one-off maintenance task which was completed by a worker, so it is not run again.
+type WorkerMigration struct {
+	Name      string `gorm:"primary_key"`
+	CreatedAt time.Time
+}
+
+// IsMigrated reports whether the maintenance task was completed.
+func IsMigrated(name string) bool {
+	var count int
+	if err := models.GetDB().Model(&WorkerMigration{}).Where("name = ?", name).Count(&count).Error; err != nil {
+		log.Printf("Error getting worker migration %s: %s", name, err)
+		return false
+	}
+	return count > 0
+}
+
+func SaveMigration(name string) {
+	if err := models.GetDB().Save(&WorkerMigration{Name: name}).Error; err != nil {
+		log.Printf("Error saving worker migration %s: %s", name, err)
+	}
+}
@@ -0,0 +1,183 @@
+package workerService
+
+import (
+	"fmt"
+	"github.com/deploji/deploji-server/dto"
+	"github.com/deploji/deploji-worker/brokerService"
+	"github.com/deploji/deploji-worker/utils"
+	"github.com/deploji/deploji-worker/workerModels"
+	"golang.org/x/net/context"
+	"log"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Version of the worker, set at build time with -ldflags "-X github.com/deploji/deploji-worker/workerService.Version=..."
+var Version = "dev"
+
+type HeartbeatType string
+
+const (
+	HeartbeatTypeAlive   HeartbeatType = "heartbeat"
+	HeartbeatTypeGoodbye HeartbeatType = "goodbye"
+)
+
+// JobQueue is the queue consumed by all workers, workers with labels also consume JobQueue.<label>.
+const JobQueue = "jobs"
+
+// Worker identifies this worker instance.
+type Worker struct {
+	ID             string
+	Hostname       string
+	Version        string
+	AnsibleVersion string
+	Labels         []string
+}
+
+// Heartbeat is published periodically to let the server know the worker is alive and what it is running.
+// A goodbye heartbeat is published when the worker shuts down.
+type Heartbeat struct {
+	Type      HeartbeatType
+	Timestamp time.Time
+	Worker
+	Slots     int
+	UsedSlots int
+	FreeSlots int
+	JobIDs    []uint
+}
+
+var (
+	worker     Worker
+	workerOnce sync.Once
+)
+
+// Info returns the identification of this worker. WORKER_ID defaults to the hostname,
+// WORKER_LABELS is a comma separated list of labels.
+func Info() Worker {
+	workerOnce.Do(func() {
+		hostname, err := os.Hostname()
+		if err != nil {
+			log.Printf("Cannot get hostname: %s", err)
+		}
+		worker = Worker{
+			ID:             os.Getenv("WORKER_ID"),
+			Hostname:       hostname,
+			Version:        Version,
+			AnsibleVersion: ansibleVersion(),
+			Labels:         parseLabels(os.Getenv("WORKER_LABELS")),
+		}
+		if worker.ID == "" {
+			worker.ID = hostname
+		}
+	})
+	return worker
+}
+
+func parseLabels(labels string) []string {
+	parsed := make([]string, 0)
+	for _, label := range strings.Split(labels, ",") {
+		if label = strings.TrimSpace(label); label != "" {
+			parsed = append(parsed, label)
+		}
+	}
+	return parsed
+}
+
+// HasLabel reports whether the worker is labeled with given label.
+func (w Worker) HasLabel(label string) bool {
+	for _, l := range w.Labels {
+		if l == label {
+			return true
+		}
+	}
+	return false
+}
+
+// Queues returns names of job queues consumed by the worker: the default queue and a queue per label.
+func (w Worker) Queues() []string {
+	queues := []string{JobQueue}
+	for _, label := range w.Labels {
+		queues = append(queues, LabelQueue(label))
+	}
+	return queues
+}
+
+// LabelQueue returns the name of the queue of jobs targeting workers with given label.
+func LabelQueue(label string) string {
+	return fmt.Sprintf("%s.%s", JobQueue, label)
+}
+
+var ansibleVersionPattern = regexp.MustCompile(`\d+\.\d+[\w.\-]*`)
+
+// ansibleVersion returns the version reported by ansible-playbook --version.
+func ansibleVersion() string {
+	output, err := exec.Command("ansible-playbook", "--version").Output()
+	if err != nil {
+		log.Printf("Cannot get ansible version: %s", err)
+		return ""
+	}
+	firstLine := strings.SplitN(string(output), "\n", 2)[0]
+	if version := ansibleVersionPattern.FindString(firstLine); version != "" {
+		return version
+	}
+	return strings.TrimSpace(firstLine)
+}
+
+// NewHeartbeat returns a heartbeat describing the current state of the pool.
+func NewHeartbeat(heartbeatType HeartbeatType, pool *Pool) Heartbeat {
+	heartbeat := Heartbeat{
+		Type:      heartbeatType,
+		Timestamp: time.Now(),
+		Worker:    Info(),
+		Slots:     pool.Size(),
+		JobIDs:    make([]uint, 0),
+	}
+	for _, slot := range pool.Slots() {
+		if slot.Busy {
+			heartbeat.UsedSlots++
+		}
+		if slot.JobID != 0 {
+			heartbeat.JobIDs = append(heartbeat.JobIDs, slot.JobID)
+		}
+	}
+	heartbeat.FreeSlots = heartbeat.Slots - heartbeat.UsedSlots
+	return heartbeat
+}
+
+// HeartbeatInterval returns the interval of heartbeats configured by HEARTBEAT_INTERVAL seconds, at least one second.
+func HeartbeatInterval() time.Duration {
+	interval := utils.GetEnvInt("HEARTBEAT_INTERVAL", 10)
+	if interval < 1 {
+		interval = 1
+	}
+	return time.Duration(interval) * time.Second
+}
+
+// SendHeartbeats publishes a heartbeat every interval until ctx is cancelled, then publishes a goodbye.
+// Heartbeats are also recorded in the database, so other workers can tell which jobs are run by live workers.
+func SendHeartbeats(ctx context.Context, broker brokerService.Broker, pool *Pool, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		sendHeartbeat(broker, NewHeartbeat(HeartbeatTypeAlive, pool))
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			sendHeartbeat(broker, NewHeartbeat(HeartbeatTypeGoodbye, pool))
+			return
+		}
+	}
+}
+
+func sendHeartbeat(broker brokerService.Broker, heartbeat Heartbeat) {
+	broker.PublishHeartbeat(dto.MarshallMessage(heartbeat))
+	workerModels.SaveWorkerHeartbeat(workerModels.NewWorkerHeartbeat(heartbeat.ID, heartbeat.Timestamp, heartbeat.Type == HeartbeatTypeGoodbye, heartbeat.JobIDs))
+}
+
+func (w Worker) String() string {
+	return fmt.Sprintf("%s (%s, version %s, ansible %s)", w.ID, w.Hostname, w.Version, w.AnsibleVersion)
+}
@@ -0,0 +1,22 @@
+package workerService
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestHeartbeatInterval(t *testing.T) {
+	defer os.Unsetenv("HEARTBEAT_INTERVAL")
+	for value, expected := range map[string]time.Duration{
+		"":   10 * time.Second,
+		"30": 30 * time.Second,
+		"0":  time.Second,
+		"-5": time.Second,
+	} {
+		os.Setenv("HEARTBEAT_INTERVAL", value)
+		if interval := HeartbeatInterval(); interval != expected {
+			t.Errorf("HEARTBEAT_INTERVAL=%q: expected %s, got %s", value, expected, interval)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package workerService
+
+import (
+	"errors"
+	"github.com/deploji/deploji-worker/brokerService"
+	"golang.org/x/net/context"
+	"log"
+	"sync"
+	"time"
+)
+
+// Reasons of cancelling a job context, see CancelReason.
+var (
+	ErrJobCancelled   = errors.New("job cancelled")
+	ErrJobInterrupted = errors.New("job interrupted by worker shutdown")
+)
+
+type reasonKey struct{}
+
+// cancelReason records why a job context was cancelled.
+type cancelReason struct {
+	mutex sync.Mutex
+	err   error
+}
+
+// CancelReason returns the reason the job context was cancelled by the pool: ErrJobCancelled or ErrJobInterrupted.
+// For contexts cancelled for other reasons it returns ctx.Err().
+func CancelReason(ctx context.Context) error {
+	if reason, ok := ctx.Value(reasonKey{}).(*cancelReason); ok {
+		reason.mutex.Lock()
+		defer reason.mutex.Unlock()
+		if reason.err != nil {
+			return reason.err
+		}
+	}
+	return ctx.Err()
+}
+
+// Slot is a single execution slot of the pool. A slot runs at most one job at a time.
+type Slot struct {
+	ID        int
+	mutex     sync.RWMutex
+	busy      bool
+	jobID     uint
+	startedAt time.Time
+	ctx       context.Context
+	cancel    context.CancelFunc
+	reason    *cancelReason
+}
+
+// SlotInfo is a point in time snapshot of a Slot.
+type SlotInfo struct {
+	ID        int
+	Busy      bool
+	JobID     uint
+	StartedAt time.Time
+}
+
+// SetJob marks the slot as busy running given job.
+func (s *Slot) SetJob(jobID uint) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.jobID = jobID
+	s.startedAt = time.Now()
+}
+
+// Context returns the context of the job run in the slot. It is cancelled when the job is cancelled
+// or interrupted by the pool, use CancelReason to tell these apart.
+func (s *Slot) Context() context.Context {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.ctx
+}
+
+// Cancel cancels the context of the running job with given reason.
+func (s *Slot) Cancel(reason error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if !s.busy {
+		return
+	}
+	s.reason.mutex.Lock()
+	if s.reason.err == nil {
+		s.reason.err = reason
+	}
+	s.reason.mutex.Unlock()
+	s.cancel()
+}
+
+func (s *Slot) acquire() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.busy = true
+	s.reason = &cancelReason{}
+	s.ctx, s.cancel = context.WithCancel(context.WithValue(context.Background(), reasonKey{}, s.reason))
+}
+
+func (s *Slot) release() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.cancel()
+	s.busy = false
+	s.jobID = 0
+	s.startedAt = time.Time{}
+}
+
+func (s *Slot) info() SlotInfo {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return SlotInfo{ID: s.ID, Busy: s.busy, JobID: s.jobID, StartedAt: s.startedAt}
+}
+
+// Handler processes a single job delivery inside given slot.
+// The handler is expected to acknowledge the delivery once the job is finished.
+type Handler func(delivery *brokerService.Delivery, slot *Slot)
+
+// Pool runs jobs concurrently in a fixed number of execution slots.
+type Pool struct {
+	slots []*Slot
+	wg    sync.WaitGroup
+}
+
+func NewPool(size int) *Pool {
+	if size < 1 {
+		size = 1
+	}
+	slots := make([]*Slot, size)
+	for i := range slots {
+		slots[i] = &Slot{ID: i + 1}
+	}
+	return &Pool{slots: slots}
+}
+
+// Size returns the number of execution slots.
+func (p *Pool) Size() int {
+	return len(p.slots)
+}
+
+// Run starts one goroutine per slot, each draining deliveries and passing them to the handler.
+// It returns immediately, use Wait to block until deliveries is closed and all jobs are finished.
+func (p *Pool) Run(deliveries <-chan *brokerService.Delivery, handler Handler) {
+	for _, slot := range p.slots {
+		p.wg.Add(1)
+		go func(slot *Slot) {
+			defer p.wg.Done()
+			for delivery := range deliveries {
+				p.process(slot, delivery, handler)
+			}
+		}(slot)
+	}
+	log.Printf("worker pool started with %d slots", len(p.slots))
+}
+
+func (p *Pool) process(slot *Slot, delivery *brokerService.Delivery, handler Handler) {
+	slot.acquire()
+	defer slot.release()
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("slot %d: job panicked: %v", slot.ID, r)
+		}
+		// The handler did not finish the job, requeue it so it is not lost.
+		if !delivery.Acknowledged() {
+			log.Printf("slot %d: requeueing unacknowledged delivery %d", slot.ID, delivery.DeliveryTag)
+			if err := delivery.Nack(true); err != nil {
+				log.Printf("slot %d: cannot nack delivery %d: %s", slot.ID, delivery.DeliveryTag, err)
+			}
+		}
+	}()
+	handler(delivery, slot)
+}
+
+// Wait blocks until all slots are finished.
+func (p *Pool) Wait() {
+	p.wg.Wait()
+}
+
+// Cancel cancels the job with given ID if it is running in one of the slots.
+func (p *Pool) Cancel(jobID uint) bool {
+	if jobID == 0 {
+		return false
+	}
+	for _, slot := range p.slots {
+		if slot.info().JobID == jobID {
+			slot.Cancel(ErrJobCancelled)
+			return true
+		}
+	}
+	return false
+}
+
+// Shutdown waits for running jobs to finish, the deliveries channel passed to Run must be closed beforehand.
+// Jobs still running after the grace period are interrupted by cancelling their context.
+func (p *Pool) Shutdown(grace time.Duration) {
+	finished := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(finished)
+	}()
+	log.Printf("waiting up to %s for %d running jobs", grace, p.Busy())
+	select {
+	case <-finished:
+		return
+	case <-time.After(grace):
+		log.Printf("grace period exceeded, interrupting %d running jobs", p.Busy())
+		for _, slot := range p.slots {
+			slot.Cancel(ErrJobInterrupted)
+		}
+	}
+	<-finished
+}
+
+// Slots returns a snapshot of all slots.
+func (p *Pool) Slots() []SlotInfo {
+	infos := make([]SlotInfo, len(p.slots))
+	for i, slot := range p.slots {
+		infos[i] = slot.info()
+	}
+	return infos
+}
+
+// Busy returns the number of slots currently running a job.
+func (p *Pool) Busy() int {
+	busy := 0
+	for _, slot := range p.Slots() {
+		if slot.Busy {
+			busy++
+		}
+	}
+	return busy
+}
@@ -0,0 +1,70 @@
+package workerService
+
+import (
+	"github.com/deploji/deploji-server/dto"
+	"github.com/deploji/deploji-worker/brokerService"
+	"golang.org/x/net/context"
+	"testing"
+	"time"
+)
+
+func TestPoolRequeuesUnacknowledgedDeliveries(t *testing.T) {
+	broker := brokerService.NewMemoryBroker()
+	ctx, cancel := context.WithCancel(context.Background())
+	deliveries := make(chan *brokerService.Delivery)
+	go func() {
+		broker.SubscribeJobs(ctx, []string{"jobs"}, 2, deliveries)
+		close(deliveries)
+	}()
+
+	processed := make(chan string, 3)
+	pool := NewPool(2)
+	pool.Run(deliveries, func(delivery *brokerService.Delivery, slot *Slot) {
+		processed <- string(delivery.Body)
+		if string(delivery.Body) == "panic" && !delivery.Redelivered {
+			panic("job failed")
+		}
+		delivery.Ack()
+	})
+
+	broker.Enqueue("jobs", dto.Message("ok"))
+	broker.Enqueue("jobs", dto.Message("panic"))
+	for i := 0; i < 3; i++ {
+		select {
+		case <-processed:
+		case <-time.After(time.Second):
+			t.Fatalf("expected 3 processed deliveries, got %d", i)
+		}
+	}
+	cancel()
+	pool.Shutdown(time.Second)
+
+	if pending := broker.Pending("jobs"); pending != 0 {
+		t.Errorf("expected no pending messages, actual %d", pending)
+	}
+}
+
+func TestPoolCancel(t *testing.T) {
+	deliveries := make(chan *brokerService.Delivery)
+	reasons := make(chan error)
+	pool := NewPool(1)
+	pool.Run(deliveries, func(delivery *brokerService.Delivery, slot *Slot) {
+		slot.SetJob(7)
+		<-slot.Context().Done()
+		reasons <- CancelReason(slot.Context())
+		delivery.Ack()
+	})
+
+	broker := brokerService.NewMemoryBroker()
+	broker.Enqueue("jobs", dto.Message("job"))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go broker.SubscribeJobs(ctx, []string{"jobs"}, 1, deliveries)
+
+	for !pool.Cancel(7) {
+		time.Sleep(time.Millisecond)
+	}
+	if reason := <-reasons; reason != ErrJobCancelled {
+		t.Errorf("expected %s, actual %v", ErrJobCancelled, reason)
+	}
+}